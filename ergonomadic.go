@@ -7,14 +7,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "ergonomadic <run|genpasswd|initdb|upgradedb> [options]")
-	fmt.Fprintln(os.Stderr, "  run -conf <config>     -- run server")
-	fmt.Fprintln(os.Stderr, "  initdb -conf <config>  -- initialize database")
-	fmt.Fprintln(os.Stderr, "  upgrade -conf <config> -- upgrade database")
-	fmt.Fprintln(os.Stderr, "  genpasswd <password>   -- bcrypt a password")
+	fmt.Fprintln(os.Stderr, "  run -conf <config>       -- run server")
+	fmt.Fprintln(os.Stderr, "  initdb -conf <config>    -- initialize database")
+	fmt.Fprintln(os.Stderr, "  upgradedb -conf <config> -- back up and upgrade database")
+	fmt.Fprintln(os.Stderr, "  genpasswd <password>     -- bcrypt a password")
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "software version:", irc.SEM_VER)
 	flag.PrintDefaults()
@@ -36,6 +37,19 @@ func loadConfig(conf string) *irc.Config {
 func genPasswd() {
 }
 
+// restart replaces the process with a fresh copy of the binary, started from
+// the original working directory with the original arguments.
+func restart(wd string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err = os.Chdir(wd); err != nil {
+		return err
+	}
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
+
 func main() {
 	var conf string
 	flag.Usage = usage
@@ -57,7 +71,7 @@ func main() {
 	case "initdb":
 		runFlags.Parse(flag.Args()[1:])
 		config := loadConfig(conf)
-		irc.InitDB(config.Server.Database)
+		irc.InitDB(config.Server.Database, config.Casemapping())
 		log.Println("database initialized: ", config.Server.Database)
 
 	case "upgradedb":
@@ -68,12 +82,22 @@ func main() {
 
 	case "run":
 		runFlags.Parse(flag.Args()[1:])
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalln("getwd error:", err)
+		}
 		config := loadConfig(conf)
 		irc.Log.SetLevel(config.Server.Log)
 		server := irc.NewServer(config)
 		log.Println(irc.SEM_VER, "running")
-		defer log.Println(irc.SEM_VER, "exiting")
-		server.Run()
+		status := server.Run()
+		if status == irc.EXIT_RESTART {
+			log.Println(irc.SEM_VER, "restarting")
+			err = restart(wd)
+			log.Println("restart error:", err)
+		}
+		log.Println(irc.SEM_VER, "exiting")
+		os.Exit(status)
 
 	default:
 		usage()
@@ -0,0 +1,107 @@
+package irc
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrAccountExists = errors.New("account already exists")
+	ErrCertFPExists  = errors.New("certificate belongs to another account")
+	ErrNoSuchAccount = errors.New("no such account")
+)
+
+type Account struct {
+	certfp  string
+	created time.Time
+	hash    []byte
+	name    Name
+}
+
+func (account *Account) CheckPassword(password []byte) error {
+	return ComparePassword(account.hash, password)
+}
+
+//
+// account store
+//
+
+// AccountStore reads and writes the `account` table. Accounts are keyed by
+// the folded name so that lookups ignore case like nicknames do.
+type AccountStore struct {
+	db *sql.DB
+}
+
+func NewAccountStore(db *sql.DB) *AccountStore {
+	return &AccountStore{
+		db: db,
+	}
+}
+
+func (store *AccountStore) get(where string, arg interface{}) (*Account, error) {
+	var name, password, certfp string
+	var created int64
+	err := store.db.QueryRow(`
+        SELECT name, password, certfp, created FROM account WHERE `+where,
+		arg).Scan(&name, &password, &certfp, &created)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchAccount
+	} else if err != nil {
+		return nil, err
+	}
+
+	account := &Account{
+		certfp:  certfp,
+		created: time.Unix(created, 0),
+		name:    Name(name),
+	}
+	if account.hash, err = DecodePassword(password); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (store *AccountStore) Get(name Name) (*Account, error) {
+	return store.get("key = ?", name.ToLower().String())
+}
+
+func (store *AccountStore) GetByCertFP(certfp string) (*Account, error) {
+	if certfp == "" {
+		return nil, ErrNoSuchAccount
+	}
+	return store.get("certfp = ?", certfp)
+}
+
+func (store *AccountStore) Add(account *Account) error {
+	if _, err := store.Get(account.name); err != ErrNoSuchAccount {
+		if err == nil {
+			err = ErrAccountExists
+		}
+		return err
+	}
+	if _, err := store.GetByCertFP(account.certfp); err != ErrNoSuchAccount {
+		if err == nil {
+			err = ErrCertFPExists
+		}
+		return err
+	}
+	_, err := store.db.Exec(`
+        INSERT INTO account (key, name, password, certfp, created)
+          VALUES (?, ?, ?, ?, ?)`,
+		account.name.ToLower().String(), account.name.String(),
+		EncodePassword(account.hash), account.certfp, account.created.Unix())
+	return err
+}
+
+func (store *AccountStore) Remove(name Name) error {
+	_, err := store.db.Exec(`DELETE FROM account WHERE key = ?`,
+		name.ToLower().String())
+	return err
+}
+
+func (store *AccountStore) SetPassword(name Name, hash []byte) error {
+	_, err := store.db.Exec(`UPDATE account SET password = ? WHERE key = ?`,
+		EncodePassword(hash), name.ToLower().String())
+	return err
+}
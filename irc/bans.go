@@ -0,0 +1,311 @@
+package irc
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BanKind rune
+
+const (
+	KLine BanKind = 'K' // user@host mask, checked at registration
+	DLine BanKind = 'D' // IP or CIDR, checked at connect
+)
+
+func (kind BanKind) String() string {
+	return string(kind)
+}
+
+type Ban struct {
+	created time.Time
+	expires time.Time // zero is permanent
+	ipnet   *net.IPNet
+	kind    BanKind
+	mask    Name
+	oper    Name
+	reason  Text
+	regexp  *regexp.Regexp
+}
+
+func NewBan(kind BanKind, mask Name) (ban *Ban, err error) {
+	ban = &Ban{
+		created: time.Now(),
+		kind:    kind,
+		mask:    mask,
+	}
+	switch kind {
+	case KLine:
+		ban.regexp, err = regexp.Compile("^" + globExpr(mask.ToLower().String()) + "$")
+
+	case DLine:
+		var nets IPNets
+		if nets, err = ParseIPNets([]string{mask.String()}); err == nil {
+			ban.ipnet = nets[0]
+		}
+	}
+	return
+}
+
+// IsWildcard reports whether the mask matches everyone: a K-line of nothing
+// but wildcards and separators, or a D-line of a /0 network.
+func (ban *Ban) IsWildcard() bool {
+	switch ban.kind {
+	case KLine:
+		return strings.Trim(ban.mask.String(), "*?@.") == ""
+
+	case DLine:
+		ones, _ := ban.ipnet.Mask.Size()
+		return ones == 0
+	}
+	return false
+}
+
+func (ban *Ban) IsExpired() bool {
+	return !ban.expires.IsZero() && time.Now().After(ban.expires)
+}
+
+func (ban *Ban) ExpiresString() string {
+	if ban.expires.IsZero() {
+		return "never"
+	}
+	return ban.expires.Format(time.RFC1123)
+}
+
+func (ban *Ban) MatchClient(client *Client) bool {
+	switch ban.kind {
+	case KLine:
+		userhost := Name(fmt.Sprintf("%s@%s", client.username, client.hostname))
+		if ban.regexp.MatchString(userhost.ToLower().String()) {
+			return true
+		}
+		userip := Name(fmt.Sprintf("%s@%s", client.username, client.ip))
+		return (client.ip != nil) && ban.regexp.MatchString(userip.ToLower().String())
+
+	case DLine:
+		return (client.ip != nil) && ban.ipnet.Contains(client.ip)
+	}
+	return false
+}
+
+// ParseBanDuration reads a bare number as minutes, like other daemons, or
+// a Go duration such as "12h".
+func ParseBanDuration(str string) (time.Duration, error) {
+	if minutes, err := strconv.ParseUint(str, 10, 32); err == nil {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	return time.ParseDuration(str)
+}
+
+//
+// ban list
+//
+
+// BanList keeps server bans in memory and in the `ban` table, keyed by folded
+// mask. Expired bans are dropped when they are next looked at.
+type BanList struct {
+	bans map[BanKind]map[Name]*Ban
+	db   *sql.DB
+}
+
+func NewBanList(db *sql.DB) *BanList {
+	return &BanList{
+		bans: map[BanKind]map[Name]*Ban{
+			KLine: make(map[Name]*Ban),
+			DLine: make(map[Name]*Ban),
+		},
+		db: db,
+	}
+}
+
+func (list *BanList) Load() error {
+	rows, err := list.db.Query(`
+        SELECT kind, mask, reason, oper, created, expires FROM ban`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind, mask, reason, oper string
+		var created, expires int64
+		err = rows.Scan(&kind, &mask, &reason, &oper, &created, &expires)
+		if (err != nil) || (kind == "") {
+			Log.error.Println("BanList.Load:", kind, err)
+			continue
+		}
+
+		ban, err := NewBan(BanKind(kind[0]), Name(mask))
+		if err != nil {
+			Log.error.Println("BanList.Load:", mask, err)
+			continue
+		}
+		ban.reason = Text(reason)
+		ban.oper = Name(oper)
+		ban.created = time.Unix(created, 0)
+		if expires > 0 {
+			ban.expires = time.Unix(expires, 0)
+		}
+		list.bans[ban.kind][ban.mask.ToLower()] = ban
+	}
+	list.expire()
+	return rows.Err()
+}
+
+// Add replaces any ban of the same mask, whatever its case.
+func (list *BanList) Add(ban *Ban) error {
+	if _, err := list.Remove(ban.kind, ban.mask); err != nil {
+		return err
+	}
+
+	var expires int64
+	if !ban.expires.IsZero() {
+		expires = ban.expires.Unix()
+	}
+	_, err := list.db.Exec(`
+        INSERT OR REPLACE INTO ban (kind, mask, reason, oper, created, expires)
+          VALUES (?, ?, ?, ?, ?, ?)`,
+		ban.kind.String(), ban.mask.String(), ban.reason.String(),
+		ban.oper.String(), ban.created.Unix(), expires)
+	if err != nil {
+		return err
+	}
+	list.bans[ban.kind][ban.mask.ToLower()] = ban
+	return nil
+}
+
+func (list *BanList) Remove(kind BanKind, mask Name) (bool, error) {
+	key := mask.ToLower()
+	ban := list.bans[kind][key]
+	if ban == nil {
+		return false, nil
+	}
+	_, err := list.db.Exec(`DELETE FROM ban WHERE kind = ? AND mask = ?`,
+		kind.String(), ban.mask.String())
+	if err != nil {
+		return false, err
+	}
+	delete(list.bans[kind], key)
+	return true, nil
+}
+
+func (list *BanList) expire() {
+	for kind, bans := range list.bans {
+		for mask, ban := range bans {
+			if !ban.IsExpired() {
+				continue
+			}
+			if _, err := list.Remove(kind, mask); err != nil {
+				Log.error.Println("BanList.expire:", err)
+			}
+		}
+	}
+}
+
+func (list *BanList) Match(kind BanKind, client *Client) *Ban {
+	list.expire()
+	for _, ban := range list.bans[kind] {
+		if ban.MatchClient(client) {
+			return ban
+		}
+	}
+	return nil
+}
+
+func (list *BanList) Bans(kind BanKind) []*Ban {
+	list.expire()
+	bans := make([]*Ban, 0, len(list.bans[kind]))
+	for _, ban := range list.bans[kind] {
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+//
+// commands
+//
+
+type BanCommand struct {
+	BaseCommand
+	duration time.Duration
+	force    bool
+	kind     BanKind
+	mask     Name
+	reason   Text
+}
+
+type UnBanCommand struct {
+	BaseCommand
+	kind BanKind
+	mask Name
+}
+
+func (msg *BanCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if !client.HasPrivilege(PrivBan) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	ban, err := NewBan(msg.kind, msg.mask)
+	if err != nil {
+		server.Replyf(client, "invalid %s-line mask %s: %s", msg.kind, msg.mask, err)
+		return
+	}
+	if !msg.force {
+		if ban.IsWildcard() {
+			server.Replyf(client, "%s-line %s matches everyone; use !%s to force",
+				msg.kind, msg.mask, msg.mask)
+			return
+		}
+		if ban.MatchClient(client) {
+			server.Replyf(client, "%s-line %s matches you; use !%s to force",
+				msg.kind, msg.mask, msg.mask)
+			return
+		}
+	}
+	ban.oper = client.Nick()
+	ban.reason = msg.reason
+	if msg.duration > 0 {
+		ban.expires = ban.created.Add(msg.duration)
+	}
+
+	if err := server.bans.Add(ban); err != nil {
+		Log.error.Println("BanCommand:", err)
+		server.Replyf(client, "could not add %s-line: %s", msg.kind, err)
+		return
+	}
+	server.Replyf(client, "added %s-line for %s, expires %s",
+		ban.kind, ban.mask, ban.ExpiresString())
+
+	// Connections still registering are disconnected too.
+	for target := range server.conns {
+		if ban.MatchClient(target) {
+			target.ErrYoureBannedCreep(ban)
+			target.Quit(NewText(fmt.Sprintf("%s-Lined: %s", ban.kind, ban.reason)))
+		}
+	}
+}
+
+func (msg *UnBanCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if !client.HasPrivilege(PrivBan) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	removed, err := server.bans.Remove(msg.kind, msg.mask)
+	if err != nil {
+		Log.error.Println("UnBanCommand:", err)
+		server.Replyf(client, "could not remove %s-line: %s", msg.kind, err)
+		return
+	}
+	if !removed {
+		server.Replyf(client, "no %s-line for %s", msg.kind, msg.mask)
+		return
+	}
+	server.Replyf(client, "removed %s-line for %s", msg.kind, msg.mask)
+}
@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -14,19 +15,36 @@ const (
 	CAP_NAK   CapSubCommand = "NAK"
 	CAP_CLEAR CapSubCommand = "CLEAR"
 	CAP_END   CapSubCommand = "END"
+	CAP_NEW   CapSubCommand = "NEW"
+	CAP_DEL   CapSubCommand = "DEL"
+
+	CAP_VERSION_302 = 302
 )
 
 // Capabilities are optional features a client may request from a server.
 type Capability string
 
 const (
-	MultiPrefix Capability = "multi-prefix"
-	SASL        Capability = "sasl"
+	AccountNotify Capability = "account-notify"
+	AccountTag    Capability = "account-tag"
+	CapNotify     Capability = "cap-notify"
+	ExtendedJoin  Capability = "extended-join"
+	MessageTags   Capability = "message-tags"
+	MultiPrefix   Capability = "multi-prefix"
+	SASL          Capability = "sasl"
+	ServerTime    Capability = "server-time"
 )
 
 var (
 	SupportedCapabilities = CapabilitySet{
-		MultiPrefix: true,
+		AccountNotify: true,
+		AccountTag:    true,
+		CapNotify:     true,
+		ExtendedJoin:  true,
+		MessageTags:   true,
+		MultiPrefix:   true,
+		SASL:          true,
+		ServerTime:    true,
 	}
 )
 
@@ -78,28 +96,118 @@ func (set CapabilitySet) DisableString() string {
 	return strings.Join(parts, " ")
 }
 
+// CapValues are the `key=value` parameters advertised to CAP 302 clients.
+type CapValues map[Capability]string
+
+// Strings lists the set in a stable order, with values for CAP 302 clients.
+func (set CapabilitySet) Strings(values CapValues, version int) []string {
+	strs := make([]string, 0, len(set))
+	for capability := range set {
+		str := capability.String()
+		if value := values[capability]; (value != "") && (version >= CAP_VERSION_302) {
+			str += "=" + value
+		}
+		strs = append(strs, str)
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// ReplyCaps splits a capability list over as many CAP lines as needed. Only
+// CAP 302 clients understand the "*" continuation marker; older clients get
+// a single line.
+func (client *Client) ReplyCaps(subCommand CapSubCommand, caps []string) {
+	if client.capVersion < CAP_VERSION_302 {
+		client.Reply(RplCap(client, subCommand, strings.Join(caps, " ")))
+		return
+	}
+
+	baseLen := len(RplCapMore(client, subCommand, ""))
+	from := 0
+	for to := 1; to <= len(caps); to += 1 {
+		if (to-from) > 1 && (baseLen+joinedLen(caps[from:to])) > MAX_REPLY_LEN {
+			client.Reply(RplCapMore(client, subCommand, strings.Join(caps[from:to-1], " ")))
+			from = to - 1
+		}
+	}
+	client.Reply(RplCap(client, subCommand, strings.Join(caps[from:], " ")))
+}
+
+// SetCapabilities changes what the server offers after a config reload, and
+// tells cap-notify clients what was added and removed, including those still
+// negotiating.
+func (server *Server) SetCapabilities(capabilities CapabilitySet, values CapValues) {
+	added, removed := make(CapabilitySet), make(CapabilitySet)
+	for capability := range capabilities {
+		if !server.capabilities[capability] ||
+			(server.capValues[capability] != values[capability]) {
+			added[capability] = true
+		}
+	}
+	for capability := range server.capabilities {
+		if !capabilities[capability] {
+			removed[capability] = true
+		}
+	}
+	server.capabilities, server.capValues = capabilities, values
+
+	for client := range server.conns {
+		for capability := range removed {
+			delete(client.capabilities, capability)
+		}
+		if !client.capabilities[CapNotify] {
+			continue
+		}
+		if len(removed) > 0 {
+			client.ReplyCaps(CAP_DEL, removed.Strings(nil, 0))
+		}
+		if len(added) > 0 {
+			client.ReplyCaps(CAP_NEW, added.Strings(values, client.capVersion))
+		}
+	}
+}
+
+// CAP negotiation suspends registration until END, but is also allowed
+// afterwards to change capabilities.
 func (msg *CapCommand) HandleRegServer(server *Server) {
 	client := msg.Client()
 
 	switch msg.subCommand {
 	case CAP_LS:
-		client.capState = CapNegotiating
-		client.Reply(RplCap(client, CAP_LS, SupportedCapabilities))
+		if !client.registered {
+			client.capState = CapNegotiating
+		}
+		if msg.version > client.capVersion {
+			client.capVersion = msg.version
+		}
+		// CAP LS 302 implies cap-notify.
+		if client.capVersion >= CAP_VERSION_302 {
+			client.capabilities[CapNotify] = true
+		}
+		client.ReplyCaps(CAP_LS,
+			server.capabilities.Strings(server.capValues, client.capVersion))
 
 	case CAP_LIST:
-		client.Reply(RplCap(client, CAP_LIST, client.capabilities))
+		client.ReplyCaps(CAP_LIST, client.capabilities.Strings(nil, 0))
 
 	case CAP_REQ:
+		if !client.registered {
+			client.capState = CapNegotiating
+		}
 		for capability := range msg.capabilities {
-			if !SupportedCapabilities[capability] {
-				client.Reply(RplCap(client, CAP_NAK, msg.capabilities))
+			if !server.capabilities[capability] {
+				client.Reply(RplCap(client, CAP_NAK, msg.request))
 				return
 			}
 		}
-		for capability := range msg.capabilities {
-			client.capabilities[capability] = true
+		for capability, enable := range msg.capabilities {
+			if enable {
+				client.capabilities[capability] = true
+			} else {
+				delete(client.capabilities, capability)
+			}
 		}
-		client.Reply(RplCap(client, CAP_ACK, msg.capabilities))
+		client.Reply(RplCap(client, CAP_ACK, msg.request))
 
 	case CAP_CLEAR:
 		reply := RplCap(client, CAP_ACK, client.capabilities.DisableString())
@@ -107,6 +215,9 @@ func (msg *CapCommand) HandleRegServer(server *Server) {
 		client.Reply(reply)
 
 	case CAP_END:
+		if client.registered {
+			return
+		}
 		client.capState = CapNegotiated
 		server.tryRegister(client)
 
@@ -114,3 +225,7 @@ func (msg *CapCommand) HandleRegServer(server *Server) {
 		client.ErrInvalidCapCmd(msg.subCommand)
 	}
 }
+
+func (msg *CapCommand) HandleServer(server *Server) {
+	msg.HandleRegServer(server)
+}
@@ -22,9 +22,9 @@ func NewChannel(s *Server, name Name) *Channel {
 	channel := &Channel{
 		flags: make(ChannelModeSet),
 		lists: map[ChannelMode]*UserMaskSet{
-			BanMask:    NewUserMaskSet(),
-			ExceptMask: NewUserMaskSet(),
-			InviteMask: NewUserMaskSet(),
+			BanMask:    NewUserMaskSet(s.limits.maxList),
+			ExceptMask: NewUserMaskSet(s.limits.maxList),
+			InviteMask: NewUserMaskSet(s.limits.maxList),
 		},
 		members: make(MemberSet),
 		name:    name,
@@ -46,7 +46,8 @@ func (channel *Channel) Names(client *Client) {
 }
 
 func (channel *Channel) ClientIsOperator(client *Client) bool {
-	return client.flags[Operator] || channel.members.HasMode(client, ChannelOperator)
+	return client.HasPrivilege(PrivSAMode) ||
+		channel.members.HasMode(client, ChannelOperator)
 }
 
 func (channel *Channel) Nicks(target *Client) []string {
@@ -88,7 +89,7 @@ func (channel *Channel) String() string {
 
 // <mode> <mode params>
 func (channel *Channel) ModeString(client *Client) (str string) {
-	isMember := client.flags[Operator] || channel.members.Has(client)
+	isMember := client.HasPrivilege(PrivSeePrivate) || channel.members.Has(client)
 	showKey := isMember && (channel.key != "")
 	showUserLimit := channel.userLimit > 0
 
@@ -146,32 +147,40 @@ func (channel *Channel) Join(client *Client, key Text) {
 		return
 	}
 
-	isInvited := channel.lists[InviteMask].Match(client.UserHost())
+	isInvited := channel.lists[InviteMask].Match(client)
 	if channel.flags[InviteOnly] && !isInvited {
 		client.ErrInviteOnlyChan(channel)
 		return
 	}
 
-	if channel.lists[BanMask].Match(client.UserHost()) &&
+	if channel.lists[BanMask].Match(client) &&
 		!isInvited &&
-		!channel.lists[ExceptMask].Match(client.UserHost()) {
+		!channel.lists[ExceptMask].Match(client) {
 		client.ErrBannedFromChan(channel)
 		return
 	}
 
 	client.channels.Add(channel)
 	channel.members.Add(client)
-	if !channel.flags[Persistent] && (len(channel.members) == 1) {
+	isRegistered := channel.server.registry.IsRegistered(channel.name)
+	if !channel.flags[Persistent] && !isRegistered && (len(channel.members) == 1) {
 		channel.members[client][ChannelCreator] = true
 		channel.members[client][ChannelOperator] = true
 	}
 
-	reply := RplJoin(client, channel)
+	tags := NewMessageTags(nil)
+	reply := RplJoin(tags, client, channel, false)
+	extendedReply := RplJoin(tags, client, channel, true)
 	for member := range channel.members {
-		member.Reply(reply)
+		if member.capabilities[ExtendedJoin] {
+			member.Reply(extendedReply)
+		} else {
+			member.Reply(reply)
+		}
 	}
 	channel.GetTopic(client)
 	channel.Names(client)
+	channel.applyAccess(client)
 }
 
 func (channel *Channel) Part(client *Client, message Text) {
@@ -203,7 +212,7 @@ func (channel *Channel) GetTopic(client *Client) {
 }
 
 func (channel *Channel) SetTopic(client *Client, topic Text) {
-	if !(client.flags[Operator] || channel.members.Has(client)) {
+	if !(client.HasPrivilege(PrivSAMode) || channel.members.Has(client)) {
 		client.ErrNotOnChannel(channel)
 		return
 	}
@@ -213,7 +222,7 @@ func (channel *Channel) SetTopic(client *Client, topic Text) {
 		return
 	}
 
-	channel.topic = topic
+	channel.topic = channel.server.limits.TruncateTopic(topic)
 
 	reply := RplTopicMsg(client, channel)
 	for member := range channel.members {
@@ -226,25 +235,36 @@ func (channel *Channel) SetTopic(client *Client, topic Text) {
 }
 
 func (channel *Channel) CanSpeak(client *Client) bool {
-	if client.flags[Operator] {
+	if client.HasPrivilege(PrivSAMode) {
 		return true
 	}
 	if channel.flags[NoOutside] && !channel.members.Has(client) {
 		return false
 	}
-	if channel.flags[Moderated] && !(channel.members.HasMode(client, Voice) ||
-		channel.members.HasMode(client, ChannelOperator)) {
+	isVoiced := channel.members.HasMode(client, Voice) ||
+		channel.members.HasMode(client, ChannelOperator)
+	if channel.flags[Moderated] && !isVoiced {
+		return false
+	}
+	if !isVoiced && channel.IsMuted(client) {
 		return false
 	}
 	return true
 }
 
-func (channel *Channel) PrivMsg(client *Client, message Text) {
+// IsMuted reports a ban with the mute prefix, which lets a member stay in
+// the channel without speaking.
+func (channel *Channel) IsMuted(client *Client) bool {
+	return channel.lists[BanMask].MatchMute(client) &&
+		!channel.lists[ExceptMask].MatchMute(client)
+}
+
+func (channel *Channel) PrivMsg(client *Client, message Text, tags Tags) {
 	if !channel.CanSpeak(client) {
 		client.ErrCannotSendToChan(channel)
 		return
 	}
-	reply := RplPrivMsg(client, channel, message)
+	reply := RplTaggedPrivMsg(tags, client, channel, message)
 	for member := range channel.members {
 		if member == client {
 			continue
@@ -345,6 +365,14 @@ func (channel *Channel) applyModeMask(client *Client, mode ChannelMode, op ModeO
 	}
 
 	if op == Add {
+		if !IsValidMask(mask) {
+			client.ErrBadMask(mask)
+			return false
+		}
+		if list.IsFull() && !list.masks[mask] {
+			client.ErrBanListFull(channel, mode)
+			return false
+		}
 		return list.Add(mask)
 	}
 
@@ -454,12 +482,12 @@ func (channel *Channel) Persist() (err error) {
 	return
 }
 
-func (channel *Channel) Notice(client *Client, message Text) {
+func (channel *Channel) Notice(client *Client, message Text, tags Tags) {
 	if !channel.CanSpeak(client) {
 		client.ErrCannotSendToChan(channel)
 		return
 	}
-	reply := RplNotice(client, channel, message)
+	reply := RplTaggedNotice(tags, client, channel, message)
 	for member := range channel.members {
 		if member == client {
 			continue
@@ -468,6 +496,22 @@ func (channel *Channel) Notice(client *Client, message Text) {
 	}
 }
 
+// TagMsg relays a message that only has tags, so it only goes to members
+// that understand tags.
+func (channel *Channel) TagMsg(client *Client, tags Tags) {
+	if !channel.CanSpeak(client) {
+		client.ErrCannotSendToChan(channel)
+		return
+	}
+	reply := RplTagMsg(tags, client, channel)
+	for member := range channel.members {
+		if (member == client) || !member.capabilities[MessageTags] {
+			continue
+		}
+		member.Reply(reply)
+	}
+}
+
 func (channel *Channel) Quit(client *Client) {
 	channel.members.Remove(client)
 	client.channels.Remove(channel)
@@ -478,7 +522,7 @@ func (channel *Channel) Quit(client *Client) {
 }
 
 func (channel *Channel) Kick(client *Client, target *Client, comment Text) {
-	if !(client.flags[Operator] || channel.members.Has(client)) {
+	if !(client.HasPrivilege(PrivSAMode) || channel.members.Has(client)) {
 		client.ErrNotOnChannel(channel)
 		return
 	}
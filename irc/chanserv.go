@@ -0,0 +1,446 @@
+package irc
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNoSuchAccessLevel = errors.New("no such access level")
+
+	chanServHelp = []string{
+		"ChanServ keeps ops for registered channels.",
+		"REGISTER <channel>                        register a channel you op",
+		"DROP <channel>                            unregister (founder)",
+		"ACCESS <channel> LIST                     show the access list",
+		"ACCESS <channel> ADD <account> op|voice   grant access (founder)",
+		"ACCESS <channel> DEL <account>            revoke access (founder)",
+		"OP|DEOP <channel> [<nick>]                change ops (op access)",
+		"Members with access are opped or voiced when they join.",
+	}
+)
+
+type AccessLevel uint
+
+const (
+	AccessNone AccessLevel = iota
+	AccessVoice
+	AccessOp
+	AccessFounder
+)
+
+var (
+	accessLevelNames = map[AccessLevel]string{
+		AccessVoice:   "voice",
+		AccessOp:      "op",
+		AccessFounder: "founder",
+	}
+)
+
+func (level AccessLevel) String() string {
+	return accessLevelNames[level]
+}
+
+func ParseAccessLevel(str string) (AccessLevel, error) {
+	str = strings.ToLower(str)
+	for level, name := range accessLevelNames {
+		if name == str {
+			return level, nil
+		}
+	}
+	return AccessNone, ErrNoSuchAccessLevel
+}
+
+type ChannelAccess struct {
+	account Name
+	level   AccessLevel
+}
+
+// ChannelAccessList is keyed by folded account name.
+type ChannelAccessList map[Name]*ChannelAccess
+
+//
+// channel registry
+//
+
+// ChannelRegistry keeps the `channel_access` table in memory. A channel is
+// registered while it has a founder.
+type ChannelRegistry struct {
+	channels map[Name]ChannelAccessList // by folded channel name
+	db       *sql.DB
+}
+
+func NewChannelRegistry(db *sql.DB) *ChannelRegistry {
+	return &ChannelRegistry{
+		channels: make(map[Name]ChannelAccessList),
+		db:       db,
+	}
+}
+
+func (registry *ChannelRegistry) Load() error {
+	rows, err := registry.db.Query(`
+        SELECT channel, account, level FROM channel_access`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel, account, levelName string
+		if err = rows.Scan(&channel, &account, &levelName); err != nil {
+			Log.error.Println("ChannelRegistry.Load:", err)
+			continue
+		}
+		level, err := ParseAccessLevel(levelName)
+		if err != nil {
+			Log.error.Println("ChannelRegistry.Load:", channel, levelName, err)
+			continue
+		}
+		registry.set(Name(channel), Name(account), level)
+	}
+	return rows.Err()
+}
+
+func (registry *ChannelRegistry) set(channel Name, account Name, level AccessLevel) {
+	list := registry.channels[channel.ToLower()]
+	if list == nil {
+		list = make(ChannelAccessList)
+		registry.channels[channel.ToLower()] = list
+	}
+	list[account.ToLower()] = &ChannelAccess{
+		account: account,
+		level:   level,
+	}
+}
+
+func (registry *ChannelRegistry) Get(channel Name) ChannelAccessList {
+	return registry.channels[channel.ToLower()]
+}
+
+func (registry *ChannelRegistry) IsRegistered(channel Name) bool {
+	for _, access := range registry.Get(channel) {
+		if access.level == AccessFounder {
+			return true
+		}
+	}
+	return false
+}
+
+func (registry *ChannelRegistry) Level(channel Name, account Name) AccessLevel {
+	if account == "" {
+		return AccessNone
+	}
+	if access := registry.Get(channel)[account.ToLower()]; access != nil {
+		return access.level
+	}
+	return AccessNone
+}
+
+func (registry *ChannelRegistry) Set(channel Name, account Name, level AccessLevel) error {
+	_, err := registry.db.Exec(`
+        INSERT OR REPLACE INTO channel_access (channel, account, level)
+          VALUES (?, ?, ?)`,
+		channel.ToLower().String(), account.String(), level.String())
+	if err == nil {
+		registry.set(channel, account, level)
+	}
+	return err
+}
+
+func (registry *ChannelRegistry) Remove(channel Name, account Name) error {
+	access := registry.Get(channel)[account.ToLower()]
+	if access == nil {
+		return nil
+	}
+	_, err := registry.db.Exec(`
+        DELETE FROM channel_access WHERE channel = ? AND account = ?`,
+		channel.ToLower().String(), access.account.String())
+	if err == nil {
+		delete(registry.Get(channel), account.ToLower())
+	}
+	return err
+}
+
+func (registry *ChannelRegistry) Drop(channel Name) error {
+	_, err := registry.db.Exec(`
+        DELETE FROM channel_access WHERE channel = ?`, channel.ToLower().String())
+	if err == nil {
+		delete(registry.channels, channel.ToLower())
+	}
+	return err
+}
+
+// RemoveAccount forgets a dropped account everywhere. Channels it founded
+// are dropped along with their access lists.
+func (registry *ChannelRegistry) RemoveAccount(account Name) error {
+	for channel, list := range registry.channels {
+		access := list[account.ToLower()]
+		if access == nil {
+			continue
+		}
+		var err error
+		if access.level == AccessFounder {
+			err = registry.Drop(channel)
+		} else {
+			err = registry.Remove(channel, access.account)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// channel modes
+//
+
+// SetMemberMode changes a member's mode on the server's behalf and tells the
+// channel.
+func (channel *Channel) SetMemberMode(source Identifiable, member *Client,
+	mode ChannelMode, op ModeOp) bool {
+	if !channel.members.Has(member) || (channel.members[member][mode] == (op == Add)) {
+		return false
+	}
+	channel.members[member][mode] = (op == Add)
+
+	reply := RplChannelMode(source, channel, ChannelModeChanges{
+		&ChannelModeChange{
+			mode: mode,
+			op:   op,
+			arg:  member.Nick().String(),
+		},
+	})
+	for m := range channel.members {
+		m.Reply(reply)
+	}
+	return true
+}
+
+// applyAccess ops or voices a member from the channel's access list.
+func (channel *Channel) applyAccess(member *Client) {
+	server := channel.server
+	switch level := server.registry.Level(channel.name, member.account); {
+	case level >= AccessOp:
+		channel.SetMemberMode(server.chanServ, member, ChannelOperator, Add)
+
+	case level >= AccessVoice:
+		channel.SetMemberMode(server.chanServ, member, Voice, Add)
+	}
+}
+
+//
+// commands
+//
+
+func NewChanServ(server *Server) *Service {
+	return NewService(server, "ChanServ", map[string]ServiceCommandFunc{
+		"ACCESS":   chanServAccess,
+		"DEOP":     chanServDeop,
+		"DROP":     chanServDrop,
+		"OP":       chanServOp,
+		"REGISTER": chanServRegister,
+	}, chanServHelp)
+}
+
+func (service *Service) checkLogin(client *Client) bool {
+	if client.account == "" {
+		service.Notice(client, "You are not logged in.")
+		return false
+	}
+	return true
+}
+
+// getChannel reports a missing channel or login to the client.
+func (service *Service) getChannel(client *Client, name Name) *Channel {
+	if !service.checkLogin(client) {
+		return nil
+	}
+	channel := service.server.channels.Get(name)
+	if channel == nil {
+		service.Notice(client, "%s does not exist.", name)
+	}
+	return channel
+}
+
+// checkRegistered reports an unregistered channel or missing login to the
+// client. A registered channel need not exist while it is empty.
+func (service *Service) checkRegistered(client *Client, channel Name) bool {
+	if !service.checkLogin(client) {
+		return false
+	}
+	if !service.server.registry.IsRegistered(channel) {
+		service.Notice(client, "%s is not registered.", channel)
+		return false
+	}
+	return true
+}
+
+// checkAccess reports insufficient access to the client.
+func (service *Service) checkAccess(client *Client, channel Name,
+	level AccessLevel) bool {
+	if service.server.registry.Level(channel, client.account) < level {
+		service.Notice(client, "You need %s access to %s.", level, channel)
+		return false
+	}
+	return true
+}
+
+func chanServRegister(service *Service, client *Client, args []string) {
+	if len(args) < 1 {
+		service.Notice(client, "Usage: REGISTER <channel>")
+		return
+	}
+	channel := service.getChannel(client, NewName(args[0]))
+	if channel == nil {
+		return
+	}
+
+	registry := service.server.registry
+	if registry.IsRegistered(channel.name) {
+		service.Notice(client, "%s is already registered.", channel)
+		return
+	}
+	if !channel.members.HasMode(client, ChannelOperator) {
+		service.Notice(client, "You must be a channel operator in %s.", channel)
+		return
+	}
+
+	if err := registry.Set(channel.name, client.account, AccessFounder); err != nil {
+		Log.error.Printf("%s: %s", service, err)
+		service.Notice(client, "Registration failed.")
+		return
+	}
+	service.Notice(client, "%s is now registered to %s.", channel, client.account)
+}
+
+func chanServDrop(service *Service, client *Client, args []string) {
+	if len(args) < 1 {
+		service.Notice(client, "Usage: DROP <channel>")
+		return
+	}
+	channel := NewName(args[0])
+	if !service.checkRegistered(client, channel) ||
+		!service.checkAccess(client, channel, AccessFounder) {
+		return
+	}
+
+	if err := service.server.registry.Drop(channel); err != nil {
+		Log.error.Printf("%s: %s", service, err)
+		service.Notice(client, "Drop failed.")
+		return
+	}
+	service.Notice(client, "%s has been dropped.", channel)
+}
+
+func chanServAccess(service *Service, client *Client, args []string) {
+	if len(args) < 2 {
+		service.Notice(client, "Usage: ACCESS <channel> LIST|ADD|DEL ...")
+		return
+	}
+	channel := NewName(args[0])
+	if !service.checkRegistered(client, channel) {
+		return
+	}
+	registry := service.server.registry
+
+	switch strings.ToUpper(args[1]) {
+	case "LIST":
+		if !service.checkAccess(client, channel, AccessOp) {
+			return
+		}
+		for _, access := range registry.Get(channel) {
+			service.Notice(client, "%s %s", access.account, access.level)
+		}
+		service.Notice(client, "End of %s access list.", channel)
+
+	case "ADD":
+		if len(args) < 4 {
+			service.Notice(client, "Usage: ACCESS <channel> ADD <account> op|voice")
+			return
+		}
+		if !service.checkAccess(client, channel, AccessFounder) {
+			return
+		}
+		level, err := ParseAccessLevel(args[3])
+		if (err != nil) || (level == AccessFounder) {
+			service.Notice(client, "Access level must be op or voice.")
+			return
+		}
+		account := service.getAccount(client, NewName(args[2]))
+		if account == nil {
+			return
+		}
+		if registry.Level(channel, account.name) == AccessFounder {
+			service.Notice(client, "%s is the founder of %s.", account.name, channel)
+			return
+		}
+		if err := registry.Set(channel, account.name, level); err != nil {
+			Log.error.Printf("%s: %s", service, err)
+			service.Notice(client, "Access change failed.")
+			return
+		}
+		service.Notice(client, "%s now has %s access to %s.", account.name, level, channel)
+
+	case "DEL":
+		if len(args) < 3 {
+			service.Notice(client, "Usage: ACCESS <channel> DEL <account>")
+			return
+		}
+		if !service.checkAccess(client, channel, AccessFounder) {
+			return
+		}
+		name := NewName(args[2])
+		switch registry.Level(channel, name) {
+		case AccessNone:
+			service.Notice(client, "%s has no access to %s.", name, channel)
+			return
+
+		case AccessFounder:
+			service.Notice(client, "Use DROP to unregister %s.", channel)
+			return
+		}
+		if err := registry.Remove(channel, name); err != nil {
+			Log.error.Printf("%s: %s", service, err)
+			service.Notice(client, "Access change failed.")
+			return
+		}
+		service.Notice(client, "%s no longer has access to %s.", name, channel)
+
+	default:
+		service.Notice(client, "Usage: ACCESS <channel> LIST|ADD|DEL ...")
+	}
+}
+
+func chanServSetOp(service *Service, client *Client, args []string, op ModeOp) {
+	if len(args) < 1 {
+		service.Notice(client, "Usage: OP|DEOP <channel> [<nick>]")
+		return
+	}
+	channel := service.getChannel(client, NewName(args[0]))
+	if (channel == nil) || !service.checkAccess(client, channel.name, AccessOp) {
+		return
+	}
+
+	target := client
+	if len(args) > 1 {
+		target = service.server.clients.Get(NewName(args[1]))
+		if target == nil {
+			service.Notice(client, "%s is not online.", args[1])
+			return
+		}
+	}
+	if !channel.members.Has(target) {
+		service.Notice(client, "%s is not in %s.", target.Nick(), channel)
+		return
+	}
+	channel.SetMemberMode(service, target, ChannelOperator, op)
+}
+
+func chanServOp(service *Service, client *Client, args []string) {
+	chanServSetOp(service, client, args, Add)
+}
+
+func chanServDeop(service *Service, client *Client, args []string) {
+	chanServSetOp(service, client, args, Remove)
+}
@@ -12,28 +12,47 @@ const (
 )
 
 type Client struct {
+	account      Name // empty until logged in
 	atime        time.Time
 	authorized   bool
 	awayMessage  Text
 	capabilities CapabilitySet
 	capState     CapState
+	capVersion   int
+	certfp       string
 	channels     ChannelSet
 	ctime        time.Time
+	fakelag      *Fakelag
 	flags        map[UserMode]bool
 	hasQuit      bool
 	hops         uint
 	hostname     Name
 	idleTimer    *time.Timer
+	ip           net.IP // set once counted by the connection limiter
 	nick         Name
+	nickTimer    *time.Timer // nick protection grace period
+	operClass    OperClass
+	operName     Name // the operator block used by OPER
 	quitTimer    *time.Timer
 	realname     Text
 	registered   bool
+	sasl         *SASLState
+	sendQFull    bool
 	server       *Server
 	socket       *Socket
 	username     Name
 }
 
 func NewClient(server *Server, conn net.Conn) *Client {
+	client := newClient(server, conn)
+	go client.run()
+
+	return client
+}
+
+// newClient does not start reading, so that a client resumed after an
+// upgrade can skip the connection checks in run.
+func newClient(server *Server, conn net.Conn) *Client {
 	now := time.Now()
 	client := &Client{
 		atime:        now,
@@ -42,12 +61,13 @@ func NewClient(server *Server, conn net.Conn) *Client {
 		capabilities: make(CapabilitySet),
 		channels:     make(ChannelSet),
 		ctime:        now,
+		fakelag:      NewFakelag(server.fakelag),
 		flags:        make(map[UserMode]bool),
 		server:       server,
-		socket:       NewSocket(conn),
+		socket:       NewSocket(conn, server.sendQ),
 	}
 	client.Touch()
-	go client.run()
+	server.conns.Add(client)
 
 	return client
 }
@@ -57,25 +77,62 @@ func NewClient(server *Server, conn net.Conn) *Client {
 //
 
 func (client *Client) run() {
+	var err error
+
+	if err = client.socket.ReadProxyHeader(); err != nil {
+		client.send(NewQuitCommand("bad PROXY header"))
+		return
+	}
+
+	// The fingerprint is only written here, before the first command reaches
+	// the server goroutine.
+	if client.certfp, err = client.socket.CertFP(); err != nil {
+		client.send(NewQuitCommand("TLS handshake failed"))
+		return
+	}
+
+	// Set the hostname for this client. On proxied listeners the address came
+	// from the PROXY header read above.
+	remoteAddr := client.socket.conn.RemoteAddr()
+	ip := AddrIP(remoteAddr)
+	if ip != nil {
+		if err = client.server.connLimit.Add(ip); err != nil {
+			client.send(NewQuitCommand(NewText(err.Error())))
+			return
+		}
+		client.ip = ip
+	}
+	client.fakelag.SetExempt(client.server.fakelag.exempt.Contains(ip))
+	client.send(NewProxyCommand(AddrLookupHostname(remoteAddr)))
+
+	client.readCommands()
+}
+
+func (client *Client) readCommands() {
 	var command Command
 	var err error
 	var line string
 
-	// Set the hostname for this client. The client may later send a PROXY
-	// command from stunnel that sets the hostname to something more accurate.
-	client.send(NewProxyCommand(AddrLookupHostname(
-		client.socket.conn.RemoteAddr())))
-
 	for err == nil {
 		if line, err = client.socket.Read(); err != nil {
 			command = NewQuitCommand("connection closed")
 
 		} else if command, err = ParseCommand(line); err != nil {
-			switch err {
+			// A bad line is not fatal, but it is answered, so it is throttled
+			// like a command.
+			parseErr := err
+			if err = client.throttle(); err != nil {
+				client.send(NewQuitCommand(NewText(err.Error())))
+				break
+			}
+			switch parseErr {
 			case ErrParseCommand:
 				client.Reply(RplNotice(client.server, client,
 					NewText("failed to parse command")))
 
+			case ErrInputTooLong:
+				client.ErrInputTooLong()
+
 			case NotEnoughArgsError:
 				// TODO
 			}
@@ -91,15 +148,44 @@ func (client *Client) run() {
 			checkPass.CheckPassword()
 		}
 
+		if err == nil {
+			client.socket.Pending(command)
+		}
+
+		// PONG is exempt so that a lagged client is not also timed out.
+		if _, isPong := command.(*PongCommand); (err == nil) && !isPong {
+			if err = client.throttle(); err != nil {
+				command = NewQuitCommand(NewText(err.Error()))
+			}
+		}
+
 		client.send(command)
 	}
 }
 
+// throttle delays the client's next line by its fakelag, and fails with
+// "Excess Flood" once the client has been delayed for too long.
+func (client *Client) throttle() error {
+	delay, err := client.fakelag.Touch()
+	time.Sleep(delay)
+	return err
+}
+
 func (client *Client) send(command Command) {
 	command.SetClient(client)
 	client.server.commands <- command
 }
 
+// Bcrypt runs password hashing on its own goroutine, since the server is
+// single-threaded for commands, then calls done back on the server goroutine
+// unless the client has quit in the meantime.
+func (client *Client) Bcrypt(work func() error, done func(error)) {
+	go func() {
+		err := work()
+		client.send(NewBcryptCommand(done, err))
+	}()
+}
+
 // quit timer goroutine
 
 func (client *Client) connectionTimeout() {
@@ -162,6 +248,10 @@ func (client *Client) destroy() {
 	// clean up server
 
 	client.server.clients.Remove(client)
+	client.server.conns.Remove(client)
+	if client.ip != nil {
+		client.server.connLimit.Remove(client.ip)
+	}
 
 	// clean up self
 
@@ -171,6 +261,9 @@ func (client *Client) destroy() {
 	if client.quitTimer != nil {
 		client.quitTimer.Stop()
 	}
+	if client.nickTimer != nil {
+		client.nickTimer.Stop()
+	}
 
 	client.socket.Close()
 
@@ -264,8 +357,22 @@ func (client *Client) ChangeNickname(nickname Name) {
 	}
 }
 
+// ChangeHostname re-indexes the client, since lookups match its usermask.
+func (client *Client) ChangeHostname(hostname Name) {
+	client.server.clients.Remove(client)
+	client.hostname = hostname
+	client.server.clients.Add(client)
+}
+
 func (client *Client) Reply(reply string) error {
-	return client.socket.Write(reply)
+	err := client.socket.Write(client.filterTags(reply))
+	if (err == ErrSendQExceeded) && !client.sendQFull {
+		client.sendQFull = true
+		// Replies are made on the server goroutine, which must not block
+		// waiting for itself to accept the quit.
+		go client.send(NewQuitCommand(NewText(err.Error())))
+	}
+	return err
 }
 
 func (client *Client) Quit(message Text) {
@@ -274,7 +381,7 @@ func (client *Client) Quit(message Text) {
 	}
 
 	client.hasQuit = true
-	client.Reply(RplError("quit"))
+	client.Reply(RplError(fmt.Sprintf("Closing link: %s", message)))
 	client.server.whoWas.Append(client)
 	friends := client.Friends()
 	friends.Remove(client)
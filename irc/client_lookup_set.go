@@ -13,6 +13,7 @@ var (
 	ErrNicknameInUse    = errors.New("nickname in use")
 	ErrNicknameMismatch = errors.New("nickname mismatch")
 	wildMaskExpr        = regexp.MustCompile(`\*|\?`)
+	userHostMaskExpr    = regexp.MustCompile(`^[^!@\s]+![^!@\s]+@[^!@\s]+$`)
 	likeQuoter          = strings.NewReplacer(
 		`\`, `\\`,
 		`%`, `\%`,
@@ -25,6 +26,13 @@ func HasWildcards(mask string) bool {
 	return wildMaskExpr.MatchString(mask)
 }
 
+// IsUserHostMask reports whether mask is a whole nick!user@host mask, with no
+// extban or mute prefix.
+func IsUserHostMask(mask Name) bool {
+	return !IsExtBan(mask) && !strings.HasPrefix(mask.String(), MUTE_PREFIX) &&
+		userHostMaskExpr.MatchString(mask.String())
+}
+
 func ExpandUserHost(userhost Name) (expanded Name) {
 	expanded = userhost
 	// fill in missing wildcards for nicks
@@ -42,14 +50,16 @@ func QuoteLike(userhost Name) string {
 }
 
 type ClientLookupSet struct {
-	byNick map[Name]*Client
-	db     *ClientDB
+	byNick     map[Name]*Client
+	bySkeleton map[string]*Client
+	db         *ClientDB
 }
 
 func NewClientLookupSet() *ClientLookupSet {
 	return &ClientLookupSet{
-		byNick: make(map[Name]*Client),
-		db:     NewClientDB(),
+		byNick:     make(map[Name]*Client),
+		bySkeleton: make(map[string]*Client),
+		db:         NewClientDB(),
 	}
 }
 
@@ -57,6 +67,12 @@ func (clients *ClientLookupSet) Get(nick Name) *Client {
 	return clients.byNick[nick.ToLower()]
 }
 
+// Confusable finds the client whose nick looks like nick, which may be the
+// client using nick itself.
+func (clients *ClientLookupSet) Confusable(nick Name) *Client {
+	return clients.bySkeleton[nick.Skeleton()]
+}
+
 func (clients *ClientLookupSet) Add(client *Client) error {
 	if !client.HasNick() {
 		return ErrNickMissing
@@ -65,6 +81,9 @@ func (clients *ClientLookupSet) Add(client *Client) error {
 		return ErrNicknameInUse
 	}
 	clients.byNick[client.Nick().ToLower()] = client
+	if skeleton := client.nick.Skeleton(); clients.bySkeleton[skeleton] == nil {
+		clients.bySkeleton[skeleton] = client
+	}
 	clients.db.Add(client)
 	return nil
 }
@@ -77,6 +96,9 @@ func (clients *ClientLookupSet) Remove(client *Client) error {
 		return ErrNicknameMismatch
 	}
 	delete(clients.byNick, client.nick.ToLower())
+	if skeleton := client.nick.Skeleton(); clients.bySkeleton[skeleton] == client {
+		delete(clients.bySkeleton, skeleton)
+	}
 	clients.db.Remove(client)
 	return nil
 }
@@ -86,7 +108,7 @@ func (clients *ClientLookupSet) FindAll(userhost Name) (set ClientSet) {
 	set = make(ClientSet)
 	rows, err := clients.db.db.Query(
 		`SELECT nickname FROM client WHERE userhost LIKE ? ESCAPE '\'`,
-		QuoteLike(userhost))
+		QuoteLike(userhost.ToLower()))
 	if err != nil {
 		Log.error.Println("ClientLookupSet.FindAll.Query:", err)
 		return
@@ -113,7 +135,7 @@ func (clients *ClientLookupSet) Find(userhost Name) *Client {
 	userhost = ExpandUserHost(userhost)
 	row := clients.db.db.QueryRow(
 		`SELECT nickname FROM client WHERE userhost LIKE ? ESCAPE '\' LIMIT 1`,
-		QuoteLike(userhost))
+		QuoteLike(userhost.ToLower()))
 	var nickname Name
 	err := row.Scan(&nickname)
 	if err != nil {
@@ -127,6 +149,8 @@ func (clients *ClientLookupSet) Find(userhost Name) *Client {
 // client db
 //
 
+// ClientDB indexes folded nicknames and usermasks, so its lookups follow the
+// casemapping like ClientLookupSet.byNick.
 type ClientDB struct {
 	db *sql.DB
 }
@@ -137,11 +161,11 @@ func NewClientDB() *ClientDB {
 	}
 	stmts := []string{
 		`CREATE TABLE client (
-          nickname TEXT NOT NULL COLLATE NOCASE UNIQUE,
-          userhost TEXT NOT NULL COLLATE NOCASE,
+          nickname TEXT NOT NULL UNIQUE,
+          userhost TEXT NOT NULL,
           UNIQUE (nickname, userhost) ON CONFLICT REPLACE)`,
-		`CREATE UNIQUE INDEX idx_nick ON client (nickname COLLATE NOCASE)`,
-		`CREATE UNIQUE INDEX idx_uh ON client (userhost COLLATE NOCASE)`,
+		`CREATE UNIQUE INDEX idx_nick ON client (nickname)`,
+		`CREATE UNIQUE INDEX idx_uh ON client (userhost)`,
 	}
 	for _, stmt := range stmts {
 		_, err := db.db.Exec(stmt)
@@ -154,7 +178,7 @@ func NewClientDB() *ClientDB {
 
 func (db *ClientDB) Add(client *Client) {
 	_, err := db.db.Exec(`INSERT INTO client (nickname, userhost) VALUES (?, ?)`,
-		client.Nick().String(), client.UserHost().String())
+		client.Nick().ToLower().String(), client.UserHost().ToLower().String())
 	if err != nil {
 		Log.error.Println("ClientDB.Add:", err)
 	}
@@ -162,7 +186,7 @@ func (db *ClientDB) Add(client *Client) {
 
 func (db *ClientDB) Remove(client *Client) {
 	_, err := db.db.Exec(`DELETE FROM client WHERE nickname = ?`,
-		client.Nick().String())
+		client.Nick().ToLower().String())
 	if err != nil {
 		Log.error.Println("ClientDB.Remove:", err)
 	}
@@ -173,18 +197,29 @@ func (db *ClientDB) Remove(client *Client) {
 //
 
 type UserMaskSet struct {
-	masks  map[Name]bool
-	regexp *regexp.Regexp
+	masks map[Name]bool
+	max   uint // 0 is unlimited
+	bans  *maskMatcher
+	mutes *maskMatcher // masks with MUTE_PREFIX
 }
 
-func NewUserMaskSet() *UserMaskSet {
-	return &UserMaskSet{
+func NewUserMaskSet(max uint) *UserMaskSet {
+	set := &UserMaskSet{
 		masks: make(map[Name]bool),
+		max:   max,
 	}
+	set.setRegexp()
+	return set
 }
 
+func (set *UserMaskSet) IsFull() bool {
+	return (set.max > 0) && (uint(len(set.masks)) >= set.max)
+}
+
+// Add refuses new masks once the set is full. AddAll does not, so that
+// persisted lists load whole.
 func (set *UserMaskSet) Add(mask Name) bool {
-	if set.masks[mask] {
+	if set.masks[mask] || set.IsFull() {
 		return false
 	}
 	set.masks[mask] = true
@@ -212,11 +247,13 @@ func (set *UserMaskSet) Remove(mask Name) bool {
 	return true
 }
 
-func (set *UserMaskSet) Match(userhost Name) bool {
-	if set.regexp == nil {
-		return false
-	}
-	return set.regexp.MatchString(userhost.String())
+// Match ignores mutes, which only keep a client from speaking.
+func (set *UserMaskSet) Match(client *Client) bool {
+	return set.bans.Match(client)
+}
+
+func (set *UserMaskSet) MatchMute(client *Client) bool {
+	return set.mutes.Match(client)
 }
 
 func (set *UserMaskSet) String() string {
@@ -229,33 +266,37 @@ func (set *UserMaskSet) String() string {
 	return strings.Join(masks, " ")
 }
 
-// Generate a regular expression from the set of user mask
-// strings. Masks are split at the two types of wildcards, `*` and
-// `?`. All the pieces are meta-escaped. `*` is replaced with `.*`,
-// the regexp equivalent. Likewise, `?` is replaced with `.`. The
-// parts are re-joined and finally all masks are joined into a big
-// or-expression.
-func (set *UserMaskSet) setRegexp() {
-	if len(set.masks) == 0 {
-		set.regexp = nil
-		return
+// Generate a regular expression from a user mask string. The mask
+// is split at the two types of wildcards, `*` and `?`. All the pieces
+// are meta-escaped. `*` is replaced with `.*`, the regexp
+// equivalent. Likewise, `?` is replaced with `.`. The parts are
+// re-joined.
+func globExpr(mask string) string {
+	manyParts := strings.Split(mask, "*")
+	manyExprs := make([]string, len(manyParts))
+	for mindex, manyPart := range manyParts {
+		oneParts := strings.Split(manyPart, "?")
+		oneExprs := make([]string, len(oneParts))
+		for oindex, onePart := range oneParts {
+			oneExprs[oindex] = regexp.QuoteMeta(onePart)
+		}
+		manyExprs[mindex] = strings.Join(oneExprs, ".")
 	}
+	return strings.Join(manyExprs, ".*")
+}
 
-	maskExprs := make([]string, len(set.masks))
-	index := 0
+// All hostmasks in the set are joined into a big or-expression, apart from
+// extbans and mutes.
+func (set *UserMaskSet) setRegexp() {
+	bans := make([]Name, 0, len(set.masks))
+	mutes := make([]Name, 0)
 	for mask := range set.masks {
-		manyParts := strings.Split(mask.String(), "*")
-		manyExprs := make([]string, len(manyParts))
-		for mindex, manyPart := range manyParts {
-			oneParts := strings.Split(manyPart, "?")
-			oneExprs := make([]string, len(oneParts))
-			for oindex, onePart := range oneParts {
-				oneExprs[oindex] = regexp.QuoteMeta(onePart)
-			}
-			manyExprs[mindex] = strings.Join(oneExprs, ".")
+		if strings.HasPrefix(mask.String(), MUTE_PREFIX) {
+			mutes = append(mutes, Name(mask[len(MUTE_PREFIX):]))
+		} else {
+			bans = append(bans, mask)
 		}
-		maskExprs[index] = strings.Join(manyExprs, ".*")
 	}
-	expr := "^" + strings.Join(maskExprs, "|") + "$"
-	set.regexp, _ = regexp.Compile(expr)
+	set.bans = newMaskMatcher(bans)
+	set.mutes = newMaskMatcher(mutes)
 }
@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Command interface {
@@ -13,6 +14,8 @@ type Command interface {
 	Code() StringCode
 	SetClient(*Client)
 	SetCode(StringCode)
+	SetTags(Tags)
+	Tags() Tags
 }
 
 type checkPasswordCommand interface {
@@ -26,43 +29,54 @@ var (
 	NotEnoughArgsError = errors.New("not enough arguments")
 	ErrParseCommand    = errors.New("failed to parse message")
 	parseCommandFuncs  = map[StringCode]parseCommandFunc{
-		AWAY:    ParseAwayCommand,
-		CAP:     ParseCapCommand,
-		DEBUG:   ParseDebugCommand,
-		INVITE:  ParseInviteCommand,
-		ISON:    ParseIsOnCommand,
-		JOIN:    ParseJoinCommand,
-		KICK:    ParseKickCommand,
-		KILL:    ParseKillCommand,
-		LIST:    ParseListCommand,
-		MODE:    ParseModeCommand,
-		MOTD:    ParseMOTDCommand,
-		NAMES:   ParseNamesCommand,
-		NICK:    ParseNickCommand,
-		NOTICE:  ParseNoticeCommand,
-		ONICK:   ParseOperNickCommand,
-		OPER:    ParseOperCommand,
-		PART:    ParsePartCommand,
-		PASS:    ParsePassCommand,
-		PING:    ParsePingCommand,
-		PONG:    ParsePongCommand,
-		PRIVMSG: ParsePrivMsgCommand,
-		PROXY:   ParseProxyCommand,
-		QUIT:    ParseQuitCommand,
-		THEATER: ParseTheaterCommand, // nonstandard
-		TIME:    ParseTimeCommand,
-		TOPIC:   ParseTopicCommand,
-		USER:    ParseUserCommand,
-		VERSION: ParseVersionCommand,
-		WHO:     ParseWhoCommand,
-		WHOIS:   ParseWhoisCommand,
-		WHOWAS:  ParseWhoWasCommand,
+		AUTHENTICATE: ParseAuthenticateCommand,
+		AWAY:         ParseAwayCommand,
+		CAP:          ParseCapCommand,
+		DEBUG:        ParseDebugCommand,
+		DIE:          ParseDieCommand,
+		DLINE:        ParseDLineCommand,
+		INVITE:       ParseInviteCommand,
+		ISON:         ParseIsOnCommand,
+		JOIN:         ParseJoinCommand,
+		KICK:         ParseKickCommand,
+		KILL:         ParseKillCommand,
+		KLINE:        ParseKLineCommand,
+		LIST:         ParseListCommand,
+		MODE:         ParseModeCommand,
+		MOTD:         ParseMOTDCommand,
+		NAMES:        ParseNamesCommand,
+		NICK:         ParseNickCommand,
+		NOTICE:       ParseNoticeCommand,
+		ONICK:        ParseOperNickCommand,
+		OPER:         ParseOperCommand,
+		PART:         ParsePartCommand,
+		PASS:         ParsePassCommand,
+		PING:         ParsePingCommand,
+		PONG:         ParsePongCommand,
+		PRIVMSG:      ParsePrivMsgCommand,
+		PROXY:        ParseProxyCommand,
+		QUIT:         ParseQuitCommand,
+		REHASH:       ParseRehashCommand,
+		RESTART:      ParseRestartCommand,
+		TAGMSG:       ParseTagMsgCommand,
+		STATS:        ParseStatsCommand,
+		THEATER:      ParseTheaterCommand, // nonstandard
+		TIME:         ParseTimeCommand,
+		TOPIC:        ParseTopicCommand,
+		UNDLINE:      ParseUnDLineCommand,
+		UNKLINE:      ParseUnKLineCommand,
+		USER:         ParseUserCommand,
+		VERSION:      ParseVersionCommand,
+		WHO:          ParseWhoCommand,
+		WHOIS:        ParseWhoisCommand,
+		WHOWAS:       ParseWhoWasCommand,
 	}
 )
 
 type BaseCommand struct {
 	client *Client
 	code   StringCode
+	tags   Tags
 }
 
 func (command *BaseCommand) Client() *Client {
@@ -81,8 +95,19 @@ func (command *BaseCommand) SetCode(code StringCode) {
 	command.code = code
 }
 
+func (command *BaseCommand) Tags() Tags {
+	return command.tags
+}
+
+func (command *BaseCommand) SetTags(tags Tags) {
+	command.tags = tags
+}
+
 func ParseCommand(line string) (cmd Command, err error) {
-	code, args := ParseLine(line)
+	tags, code, args, err := ParseLine(line)
+	if err != nil {
+		return
+	}
 	constructor := parseCommandFuncs[code]
 	if constructor == nil {
 		cmd = ParseUnknownCommand(args)
@@ -91,6 +116,7 @@ func ParseCommand(line string) (cmd Command, err error) {
 	}
 	if cmd != nil {
 		cmd.SetCode(code)
+		cmd.SetTags(tags)
 	}
 	return
 }
@@ -110,8 +136,22 @@ func splitArg(line string) (arg string, rest string) {
 	return
 }
 
-func ParseLine(line string) (command StringCode, args []string) {
+// [ "@" <tags> " " ] [ ":" <prefix> " " ] <command> [ <params> ]
+func ParseLine(line string) (tags Tags, command StringCode, args []string, err error) {
 	args = make([]string, 0)
+	if strings.HasPrefix(line, "@") {
+		var tagStr string
+		tagStr, line = splitArg(line[len("@"):])
+		if len(tagStr) >= MAX_TAGS_LEN {
+			err = ErrInputTooLong
+			return
+		}
+		tags = ParseTags(tagStr)
+		if len(tags.ClientOnly().String()) > MAX_CLIENT_TAGS_LEN {
+			err = ErrInputTooLong
+			return
+		}
+	}
 	if strings.HasPrefix(line, ":") {
 		_, line = splitArg(line)
 	}
@@ -621,32 +661,52 @@ func ParseWhoCommand(args []string) (Command, error) {
 
 type OperCommand struct {
 	PassCommand
-	name Name
+	name   Name
+	certfp string
 }
 
 func (msg *OperCommand) LoadPassword(server *Server) {
-	msg.hash = server.operators[msg.name]
+	operator := server.operators[msg.name]
+	if operator == nil {
+		return
+	}
+	msg.hash = operator.hash
+	msg.certfp = operator.certfp
+}
+
+// A matching client certificate makes the password unnecessary.
+func (msg *OperCommand) IsAuthenticated() bool {
+	if (msg.certfp != "") && (msg.certfp == msg.Client().certfp) {
+		return true
+	}
+	return (msg.hash != nil) && (msg.err == nil)
 }
 
-// OPER <name> <password>
+// OPER <name> [ <password> ]
 func ParseOperCommand(args []string) (Command, error) {
-	if len(args) < 2 {
+	if len(args) < 1 {
 		return nil, NotEnoughArgsError
 	}
 
 	cmd := &OperCommand{
 		name: NewName(args[0]),
 	}
-	cmd.password = []byte(args[1])
+	if len(args) > 1 {
+		cmd.password = []byte(args[1])
+	}
 	return cmd, nil
 }
 
 type CapCommand struct {
 	BaseCommand
 	subCommand   CapSubCommand
-	capabilities CapabilitySet
+	capabilities CapabilitySet // false disables a capability
+	request      string
+	version      int
 }
 
+// CAP LS [ <version> ]
+// CAP REQ :[ "-" ] <capability> *( " " [ "-" ] <capability> )
 func ParseCapCommand(args []string) (Command, error) {
 	if len(args) < 1 {
 		return nil, NotEnoughArgsError
@@ -658,15 +718,75 @@ func ParseCapCommand(args []string) (Command, error) {
 	}
 
 	if len(args) > 1 {
-		strs := spacesExpr.Split(args[1], -1)
-		for _, str := range strs {
-			cmd.capabilities[Capability(str)] = true
+		if cmd.subCommand == CAP_LS {
+			cmd.version, _ = strconv.Atoi(args[1])
+			return cmd, nil
+		}
+
+		cmd.request = strings.TrimSpace(args[1])
+		for _, str := range strings.Fields(cmd.request) {
+			if strings.HasPrefix(str, Disable.String()) {
+				cmd.capabilities[Capability(str[len(Disable.String()):])] = false
+			} else {
+				cmd.capabilities[Capability(str)] = true
+			}
 		}
 	}
 	return cmd, nil
 }
 
-// HAPROXY support
+// AUTHENTICATE <mechanism>
+// AUTHENTICATE <base64 chunk> | "+" | "*"
+
+type AuthenticateCommand struct {
+	BaseCommand
+	arg string
+}
+
+func ParseAuthenticateCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	return &AuthenticateCommand{
+		arg: args[0],
+	}, nil
+}
+
+// BcryptCommand brings the result of Client.Bcrypt back to the server
+// goroutine. It is never parsed from client input.
+type BcryptCommand struct {
+	BaseCommand
+	done func(error)
+	err  error
+}
+
+func NewBcryptCommand(done func(error), err error) *BcryptCommand {
+	cmd := &BcryptCommand{
+		done: done,
+		err:  err,
+	}
+	cmd.code = BCRYPT
+	return cmd
+}
+
+// NickProtectCommand is sent when an unidentified client's grace period on a
+// registered nick runs out.
+type NickProtectCommand struct {
+	BaseCommand
+	nick Name
+}
+
+func NewNickProtectCommand(nick Name) *NickProtectCommand {
+	cmd := &NickProtectCommand{
+		nick: nick,
+	}
+	cmd.code = NICKPROTECT
+	return cmd
+}
+
+// HAPROXY support. The socket reads real PROXY headers on proxied listeners and
+// reports the hostname with NewProxyCommand; a parsed PROXY line was sent by
+// the client itself and is never honored.
 type ProxyCommand struct {
 	BaseCommand
 	net        Name
@@ -675,6 +795,7 @@ type ProxyCommand struct {
 	sourcePort Name
 	destPort   Name
 	hostname   Name // looked up in socket thread
+	fromClient bool
 }
 
 func NewProxyCommand(hostname Name) *ProxyCommand {
@@ -695,7 +816,23 @@ func ParseProxyCommand(args []string) (Command, error) {
 		destIP:     NewName(args[2]),
 		sourcePort: NewName(args[3]),
 		destPort:   NewName(args[4]),
-		hostname:   LookupHostname(NewName(args[1])),
+		fromClient: true,
+	}, nil
+}
+
+// TAGMSG <target>
+
+type TagMsgCommand struct {
+	BaseCommand
+	target Name
+}
+
+func ParseTagMsgCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	return &TagMsgCommand{
+		target: NewName(args[0]),
 	}, nil
 }
 
@@ -833,16 +970,22 @@ func ParseNamesCommand(args []string) (Command, error) {
 type DebugCommand struct {
 	BaseCommand
 	subCommand Name
+	target     Name
 }
 
+// DEBUG <subcommand> [ <nickname> ]
 func ParseDebugCommand(args []string) (Command, error) {
 	if len(args) == 0 {
 		return nil, NotEnoughArgsError
 	}
 
-	return &DebugCommand{
+	cmd := &DebugCommand{
 		subCommand: NewName(strings.ToUpper(args[0])),
-	}, nil
+	}
+	if len(args) > 1 {
+		cmd.target = NewName(args[1])
+	}
+	return cmd, nil
 }
 
 type VersionCommand struct {
@@ -913,6 +1056,42 @@ func ParseTimeCommand(args []string) (Command, error) {
 	return cmd, nil
 }
 
+type RehashCommand struct {
+	BaseCommand
+}
+
+func ParseRehashCommand(args []string) (Command, error) {
+	return &RehashCommand{}, nil
+}
+
+type DieCommand struct {
+	BaseCommand
+	message Text
+	restart bool
+	upgrade bool // keep clients connected across the restart
+}
+
+// DIE [ <message> ]
+func ParseDieCommand(args []string) (Command, error) {
+	cmd := &DieCommand{}
+	if len(args) > 0 {
+		cmd.message = NewText(args[0])
+	}
+	return cmd, nil
+}
+
+// RESTART [ UPGRADE ] [ <message> ]
+func ParseRestartCommand(args []string) (Command, error) {
+	upgrade := (len(args) > 0) && (strings.ToUpper(args[0]) == "UPGRADE")
+	if upgrade {
+		args = args[1:]
+	}
+	cmd, _ := ParseDieCommand(args)
+	cmd.(*DieCommand).restart = true
+	cmd.(*DieCommand).upgrade = upgrade
+	return cmd, nil
+}
+
 type KillCommand struct {
 	BaseCommand
 	nickname Name
@@ -929,6 +1108,24 @@ func ParseKillCommand(args []string) (Command, error) {
 	}, nil
 }
 
+type StatsCommand struct {
+	BaseCommand
+	query  string
+	target Name
+}
+
+// STATS [ <query> [ <target> ] ]
+func ParseStatsCommand(args []string) (Command, error) {
+	cmd := &StatsCommand{}
+	if len(args) > 0 {
+		cmd.query = args[0]
+	}
+	if len(args) > 1 {
+		cmd.target = NewName(args[1])
+	}
+	return cmd, nil
+}
+
 type WhoWasCommand struct {
 	BaseCommand
 	nicknames []Name
@@ -962,3 +1159,89 @@ func ParseOperNickCommand(args []string) (Command, error) {
 		nick:   NewName(args[1]),
 	}, nil
 }
+
+// [ <duration> ] [!]<mask> [ <reason> ]
+// The ! forces a mask that matches everyone or the oper setting it.
+func parseBanArgs(args []string) (duration time.Duration, mask Name, reason Text,
+	force bool, err error) {
+	if len(args) > 1 {
+		if parsed, parseErr := ParseBanDuration(args[0]); parseErr == nil {
+			duration = parsed
+			args = args[1:]
+		}
+	}
+	if len(args) < 1 {
+		err = NotEnoughArgsError
+		return
+	}
+	mask = NewName(args[0])
+	if strings.HasPrefix(mask.String(), "!") {
+		force = true
+		mask = mask[1:]
+	}
+	if len(args) > 1 {
+		reason = NewText(args[1])
+	} else {
+		reason = "no reason"
+	}
+	return
+}
+
+// KLINE [ <duration> ] [!]<user@host> [ <reason> ]
+func ParseKLineCommand(args []string) (Command, error) {
+	duration, mask, reason, force, err := parseBanArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(mask.String(), "@") {
+		mask = "*@" + mask
+	}
+	return &BanCommand{
+		duration: duration,
+		force:    force,
+		kind:     KLine,
+		mask:     mask,
+		reason:   reason,
+	}, nil
+}
+
+// DLINE [ <duration> ] [!]<ip/cidr> [ <reason> ]
+func ParseDLineCommand(args []string) (Command, error) {
+	duration, mask, reason, force, err := parseBanArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return &BanCommand{
+		duration: duration,
+		force:    force,
+		kind:     DLine,
+		mask:     mask,
+		reason:   reason,
+	}, nil
+}
+
+// UNKLINE <user@host>
+func ParseUnKLineCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	mask := NewName(args[0])
+	if !strings.Contains(mask.String(), "@") {
+		mask = "*@" + mask
+	}
+	return &UnBanCommand{
+		kind: KLine,
+		mask: mask,
+	}, nil
+}
+
+// UNDLINE <ip/cidr>
+func ParseUnDLineCommand(args []string) (Command, error) {
+	if len(args) < 1 {
+		return nil, NotEnoughArgsError
+	}
+	return &UnBanCommand{
+		kind: DLine,
+		mask: NewName(args[0]),
+	}, nil
+}
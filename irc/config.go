@@ -2,8 +2,14 @@ package irc
 
 import (
 	"code.google.com/p/gcfg"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type PassConfig struct {
@@ -18,25 +24,321 @@ func (conf *PassConfig) PasswordBytes() []byte {
 	return bytes
 }
 
+type OperatorConfig struct {
+	PassConfig
+	CertFP   string
+	Class    string   // an operclass; every privilege if unset
+	HostMask []string // usermasks allowed to OPER; any if unset
+	VHost    string   // hostname set on OPER
+}
+
+func (conf *OperatorConfig) Validate(classes map[string]*OperClassConfig) error {
+	if conf.Class != "" {
+		found := false
+		for name := range classes {
+			found = found || strings.EqualFold(name, conf.Class)
+		}
+		if !found {
+			return fmt.Errorf("no such operclass: %s", conf.Class)
+		}
+	}
+	if conf.Password != "" {
+		if _, err := DecodePassword(conf.Password); err != nil {
+			return err
+		}
+	}
+	for _, mask := range conf.HostMask {
+		if !IsUserHostMask(NewName(mask)) {
+			return fmt.Errorf("bad hostmask, expected nick!user@host: %s", mask)
+		}
+	}
+	if strings.ContainsAny(conf.VHost, "!@*? ") {
+		return fmt.Errorf("bad vhost: %s", conf.VHost)
+	}
+	return nil
+}
+
+type OperClassConfig struct {
+	Privilege []string
+}
+
+// Fingerprints are compared as lowercase hex without separators.
+func (conf *OperatorConfig) CertFPString() string {
+	return strings.ToLower(strings.Replace(conf.CertFP, ":", "", -1))
+}
+
+type ListenerConfig struct {
+	Cert      string
+	Key       string
+	Proxy     bool // require a PROXY header from a trusted-proxy
+	WebSocket bool
+}
+
+func (conf *ListenerConfig) IsTLS() bool {
+	return (conf.Cert != "") || (conf.Key != "")
+}
+
+func (conf *ListenerConfig) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Client certificates are usually self-signed, so they are only
+		// fingerprinted, never verified.
+		ClientAuth: tls.RequestClientCert,
+	}, nil
+}
+
+type FloodConfig struct {
+	Burst  uint
+	Rate   float64
+	Limit  uint
+	Exempt []string
+}
+
+type LimitsConfig struct {
+	ChannelLen uint
+	Channels   uint // per client
+	MaxList    uint // entries per ban, except and invite list
+	NickLen    uint
+	TopicLen   uint
+}
+
+type ConnectConfig struct {
+	PerIP          uint     `gcfg:"per-ip"`
+	PerNet         uint     `gcfg:"per-net"`
+	IPv4Net        int      `gcfg:"ipv4-net"`
+	IPv6Net        int      `gcfg:"ipv6-net"`
+	Throttle       uint     // connections per address per period
+	ThrottlePeriod string   `gcfg:"throttle-period"`
+	Exempt         []string // networks never refused, e.g. a NAT gateway
+}
+
 type Config struct {
+	filename string // absolute, for rehashing after the chdir
+
 	Server struct {
 		PassConfig
-		Database string
-		Listen   []string
-		Log      string
-		MOTD     string
-		Name     string
+		Database    string
+		Listen      []string
+		Casemapping string
+		Log         string
+		MOTD        string
+		Name        string
+		QuitMessage string `gcfg:"quit-message"`
+		SendQ       int
+		// networks allowed to report a client's real address
+		TrustedProxy []string `gcfg:"trusted-proxy"`
+		// scripts exempt from confusable name checks
+		TrustedScript []string `gcfg:"trusted-script"`
 	}
 
-	Operator map[string]*PassConfig
+	Connect ConnectConfig
+
+	Flood FloodConfig
+
+	Limits LimitsConfig
+
+	Listener map[string]*ListenerConfig
+
+	Operator map[string]*OperatorConfig
+
+	OperClass map[string]*OperClassConfig
 
 	Theater map[string]*PassConfig
 }
 
-func (conf *Config) Operators() map[Name][]byte {
-	operators := make(map[Name][]byte)
+// Listeners merges the plaintext `listen` addresses of the server section with
+// the `listener` sections, which may configure TLS.
+func (conf *Config) Listeners() map[string]*ListenerConfig {
+	listeners := make(map[string]*ListenerConfig)
+	for _, addr := range conf.Server.Listen {
+		listeners[addr] = &ListenerConfig{}
+	}
+	for addr, listenerConf := range conf.Listener {
+		listeners[addr] = listenerConf
+	}
+	return listeners
+}
+
+// Capabilities are those the server offers, with their values. SASL EXTERNAL
+// needs a client certificate, so it is only offered with a TLS listener.
+func (conf *Config) Capabilities() (CapabilitySet, CapValues) {
+	capabilities := make(CapabilitySet)
+	for capability := range SupportedCapabilities {
+		capabilities[capability] = true
+	}
+
+	mechanisms := []SASLMechanism{SASLPlain}
+	for _, listenerConf := range conf.Listener {
+		if listenerConf.IsTLS() {
+			mechanisms = SupportedSASLMechanisms
+			break
+		}
+	}
+	values := CapValues{
+		SASL: SASLMechanisms(mechanisms),
+	}
+	return capabilities, values
+}
+
+type OperatorAuth struct {
+	certfp    string
+	class     OperClass
+	hash      []byte
+	hostmasks *maskMatcher // nil allows any host
+	vhost     Name
+}
+
+func (conf *Config) SendQ() int {
+	if conf.Server.SendQ > 0 {
+		return conf.Server.SendQ
+	}
+	return DEFAULT_SENDQ
+}
+
+func (conf *Config) ConnectionLimits() *ConnectionLimitConfig {
+	exempt, err := ParseIPNets(conf.Connect.Exempt)
+	if err != nil {
+		log.Fatal("connect.exempt error: ", err)
+	}
+	limits := &ConnectionLimitConfig{
+		exempt:         exempt,
+		ipv4Net:        DEFAULT_IPV4_NET,
+		ipv6Net:        DEFAULT_IPV6_NET,
+		perIP:          conf.Connect.PerIP,
+		perNet:         conf.Connect.PerNet,
+		throttle:       conf.Connect.Throttle,
+		throttlePeriod: DEFAULT_THROTTLE_PERIOD,
+	}
+	if conf.Connect.IPv4Net > 0 {
+		limits.ipv4Net = conf.Connect.IPv4Net
+	}
+	if conf.Connect.IPv6Net > 0 {
+		limits.ipv6Net = conf.Connect.IPv6Net
+	}
+	if conf.Connect.ThrottlePeriod != "" {
+		limits.throttlePeriod, err = time.ParseDuration(conf.Connect.ThrottlePeriod)
+		if err != nil {
+			log.Fatal("connect.throttle-period error: ", err)
+		}
+	}
+	return limits
+}
+
+func (conf *Config) Fakelag() *FakelagConfig {
+	exempt, err := ParseIPNets(conf.Flood.Exempt)
+	if err != nil {
+		log.Fatal("flood.exempt error: ", err)
+	}
+	fakelag := &FakelagConfig{
+		burst:  DEFAULT_FLOOD_BURST,
+		exempt: exempt,
+		limit:  DEFAULT_FLOOD_LIMIT,
+		rate:   DEFAULT_FLOOD_RATE,
+	}
+	if conf.Flood.Burst > 0 {
+		fakelag.burst = float64(conf.Flood.Burst)
+	}
+	if conf.Flood.Limit > 0 {
+		fakelag.limit = conf.Flood.Limit
+	}
+	if conf.Flood.Rate > 0 {
+		fakelag.rate = conf.Flood.Rate
+	}
+	return fakelag
+}
+
+func (conf *Config) QuitMessage() Text {
+	if conf.Server.QuitMessage != "" {
+		return NewText(conf.Server.QuitMessage)
+	}
+	return DEFAULT_QUIT_MESSAGE
+}
+
+func (conf *Config) Casemapping() Casemapping {
+	mapping, err := ParseCasemapping(conf.Server.Casemapping)
+	if err != nil {
+		log.Fatal("server.casemapping error: ", err)
+	}
+	return mapping
+}
+
+func (conf *Config) ProtocolLimits() *Limits {
+	limits := &Limits{
+		channelLen: DEFAULT_CHANNELLEN,
+		channels:   DEFAULT_CHANLIMIT,
+		maxList:    DEFAULT_MAXLIST,
+		nickLen:    DEFAULT_NICKLEN,
+		topicLen:   DEFAULT_TOPICLEN,
+	}
+	if conf.Limits.ChannelLen > 0 {
+		limits.channelLen = conf.Limits.ChannelLen
+	}
+	if conf.Limits.Channels > 0 {
+		limits.channels = conf.Limits.Channels
+	}
+	if conf.Limits.MaxList > 0 {
+		limits.maxList = conf.Limits.MaxList
+	}
+	if conf.Limits.NickLen > 0 {
+		limits.nickLen = conf.Limits.NickLen
+	}
+	if conf.Limits.TopicLen > 0 {
+		limits.topicLen = conf.Limits.TopicLen
+	}
+	return limits
+}
+
+func (conf *Config) Proxies() IPNets {
+	proxies, err := ParseIPNets(conf.Server.TrustedProxy)
+	if err != nil {
+		log.Fatal("trusted-proxy error: ", err)
+	}
+	return proxies
+}
+
+func (conf *Config) TrustedScripts() []*unicode.RangeTable {
+	scripts, err := ParseScripts(conf.Server.TrustedScript)
+	if err != nil {
+		log.Fatal("trusted-script error: ", err)
+	}
+	return scripts
+}
+
+func (conf *Config) OperClasses() map[string]OperClass {
+	classes := make(map[string]OperClass)
+	for name, classConf := range conf.OperClass {
+		class, err := NewOperClass(classConf.Privilege)
+		if err != nil {
+			log.Fatal("operclass ", name, " error: ", err)
+		}
+		classes[strings.ToLower(name)] = class
+	}
+	return classes
+}
+
+func (conf *Config) Operators() map[Name]*OperatorAuth {
+	classes := conf.OperClasses()
+	operators := make(map[Name]*OperatorAuth)
 	for name, opConf := range conf.Operator {
-		operators[NewName(name)] = opConf.PasswordBytes()
+		operator := &OperatorAuth{
+			certfp: opConf.CertFPString(),
+			class:  AllPrivileges(),
+			vhost:  NewName(opConf.VHost),
+		}
+		if opConf.Password != "" {
+			operator.hash = opConf.PasswordBytes()
+		}
+		if opConf.Class != "" {
+			operator.class = classes[strings.ToLower(opConf.Class)]
+		}
+		if len(opConf.HostMask) > 0 {
+			operator.hostmasks = newMaskMatcher(NewNames(opConf.HostMask))
+		}
+		operators[NewName(name)] = operator
 	}
 	return operators
 }
@@ -59,6 +361,9 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if err != nil {
 		return
 	}
+	if config.filename, err = filepath.Abs(filename); err != nil {
+		return
+	}
 	if config.Server.Name == "" {
 		err = errors.New("server.name missing")
 		return
@@ -67,9 +372,93 @@ func LoadConfig(filename string) (config *Config, err error) {
 		err = errors.New("server.database missing")
 		return
 	}
-	if len(config.Server.Listen) == 0 {
+	if _, err = ParseCasemapping(config.Server.Casemapping); err != nil {
+		err = fmt.Errorf("server.casemapping: %s", err)
+		return
+	}
+	if (len(config.Server.Listen) == 0) && (len(config.Listener) == 0) {
 		err = errors.New("server.listen missing")
 		return
 	}
+	if _, err = ParseIPNets(config.Server.TrustedProxy); err != nil {
+		err = fmt.Errorf("server.trusted-proxy: %s", err)
+		return
+	}
+	if _, err = ParseScripts(config.Server.TrustedScript); err != nil {
+		err = fmt.Errorf("server.trusted-script: %s", err)
+		return
+	}
+	if config.Server.Password != "" {
+		if _, err = DecodePassword(config.Server.Password); err != nil {
+			err = fmt.Errorf("server.password: %s", err)
+			return
+		}
+	}
+	for name, theaterConf := range config.Theater {
+		if !NewName(name).IsChannel() {
+			err = fmt.Errorf("theater %s: not a channel", name)
+			return
+		}
+		if _, err = DecodePassword(theaterConf.Password); err != nil {
+			err = fmt.Errorf("theater %s: %s", name, err)
+			return
+		}
+	}
+	for name, classConf := range config.OperClass {
+		if _, err = NewOperClass(classConf.Privilege); err != nil {
+			err = fmt.Errorf("operclass %s: %s", name, err)
+			return
+		}
+	}
+	for name, opConf := range config.Operator {
+		if err = opConf.Validate(config.OperClass); err != nil {
+			err = fmt.Errorf("operator %s: %s", name, err)
+			return
+		}
+	}
+	if _, err = ParseIPNets(config.Connect.Exempt); err != nil {
+		err = fmt.Errorf("connect.exempt: %s", err)
+		return
+	}
+	if (config.Connect.IPv4Net > 32) || (config.Connect.IPv6Net > 128) {
+		err = errors.New("connect: network prefix too long")
+		return
+	}
+	if config.Connect.ThrottlePeriod != "" {
+		if _, err = time.ParseDuration(config.Connect.ThrottlePeriod); err != nil {
+			err = fmt.Errorf("connect.throttle-period: %s", err)
+			return
+		}
+	}
+	if _, err = ParseIPNets(config.Flood.Exempt); err != nil {
+		err = fmt.Errorf("flood.exempt: %s", err)
+		return
+	}
+	if config.Limits.ChannelLen == 1 {
+		err = errors.New("limits.channellen must allow a name after the type")
+		return
+	}
+	if (config.Limits.NickLen > uint(MAX_REPLY_LEN/2)) ||
+		(config.Limits.ChannelLen > uint(MAX_REPLY_LEN/2)) ||
+		(config.Limits.TopicLen > uint(MAX_REPLY_LEN)) {
+		err = errors.New("limits: lengths must fit in a line")
+		return
+	}
+	for addr, listenerConf := range config.Listener {
+		if listenerConf.IsTLS() && ((listenerConf.Cert == "") || (listenerConf.Key == "")) {
+			err = fmt.Errorf("listener %s: cert and key are both required", addr)
+			return
+		}
+		if listenerConf.Proxy && (len(config.Server.TrustedProxy) == 0) {
+			err = fmt.Errorf("listener %s: proxy requires server.trusted-proxy", addr)
+			return
+		}
+	}
+	for name, opConf := range config.Operator {
+		if (opConf.Password == "") && (opConf.CertFP == "") {
+			err = fmt.Errorf("operator %s: password or certfp required", name)
+			return
+		}
+	}
 	return
 }
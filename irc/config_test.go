@@ -0,0 +1,29 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestOperatorHostMask(t *testing.T) {
+	tests := []struct {
+		mask  string
+		valid bool
+	}{
+		{"*!*@localhost", true},
+		{"alice!~a@192.0.2.*", true},
+		{"*!*@2001:db8::*", true},
+		{"*@localhost", false}, // short masks are not expanded
+		{"localhost", false},
+		{"*!*@", false},
+		{"*!*@a b", false},
+		{"$a:alice", false}, // extbans
+		{"$r:*!*@localhost", false},
+		{"m:*!*@localhost", false}, // mute prefix
+	}
+	for _, test := range tests {
+		conf := &OperatorConfig{HostMask: []string{test.mask}}
+		if err := conf.Validate(nil); (err == nil) != test.valid {
+			t.Errorf("Validate(%q) = %v, expected valid = %t", test.mask, err, test.valid)
+		}
+	}
+}
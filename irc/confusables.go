@@ -0,0 +1,173 @@
+package irc
+
+import (
+	"code.google.com/p/go.text/unicode/norm"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrNoSuchScript = errors.New("no such script")
+
+	// scripts whose letters are never replaced in a skeleton
+	trustedScripts []*unicode.RangeTable
+)
+
+// confusables maps letters that pass for Latin ones, after NFD, to the
+// letters they imitate. It is a subset of the Unicode TR39 confusables
+// data; asciiConfusables then handles look-alikes within ASCII.
+var confusables = map[rune]rune{
+	'\u0391': 'A', // GREEK CAPITAL LETTER ALPHA
+	'\u0392': 'B', // GREEK CAPITAL LETTER BETA
+	'\u0395': 'E', // GREEK CAPITAL LETTER EPSILON
+	'\u0396': 'Z', // GREEK CAPITAL LETTER ZETA
+	'\u0397': 'H', // GREEK CAPITAL LETTER ETA
+	'\u0399': 'I', // GREEK CAPITAL LETTER IOTA
+	'\u039a': 'K', // GREEK CAPITAL LETTER KAPPA
+	'\u039c': 'M', // GREEK CAPITAL LETTER MU
+	'\u039d': 'N', // GREEK CAPITAL LETTER NU
+	'\u039f': 'O', // GREEK CAPITAL LETTER OMICRON
+	'\u03a1': 'P', // GREEK CAPITAL LETTER RHO
+	'\u03a4': 'T', // GREEK CAPITAL LETTER TAU
+	'\u03a5': 'Y', // GREEK CAPITAL LETTER UPSILON
+	'\u03a7': 'X', // GREEK CAPITAL LETTER CHI
+	'\u03f9': 'C', // GREEK CAPITAL LUNATE SIGMA SYMBOL
+	'\u037f': 'J', // GREEK CAPITAL LETTER YOT
+	'\u03b1': 'a', // GREEK SMALL LETTER ALPHA
+	'\u03b9': 'i', // GREEK SMALL LETTER IOTA
+	'\u03bd': 'v', // GREEK SMALL LETTER NU
+	'\u03bf': 'o', // GREEK SMALL LETTER OMICRON
+	'\u03c1': 'p', // GREEK SMALL LETTER RHO
+	'\u03c5': 'u', // GREEK SMALL LETTER UPSILON
+	'\u03c7': 'x', // GREEK SMALL LETTER CHI
+	'\u03b3': 'y', // GREEK SMALL LETTER GAMMA
+	'\u03f2': 'c', // GREEK LUNATE SIGMA SYMBOL
+	'\u03f3': 'j', // GREEK LETTER YOT
+	'\u0410': 'A', // CYRILLIC CAPITAL LETTER A
+	'\u0412': 'B', // CYRILLIC CAPITAL LETTER VE
+	'\u0415': 'E', // CYRILLIC CAPITAL LETTER IE
+	'\u041a': 'K', // CYRILLIC CAPITAL LETTER KA
+	'\u041c': 'M', // CYRILLIC CAPITAL LETTER EM
+	'\u041d': 'H', // CYRILLIC CAPITAL LETTER EN
+	'\u041e': 'O', // CYRILLIC CAPITAL LETTER O
+	'\u0420': 'P', // CYRILLIC CAPITAL LETTER ER
+	'\u0421': 'C', // CYRILLIC CAPITAL LETTER ES
+	'\u0422': 'T', // CYRILLIC CAPITAL LETTER TE
+	'\u0425': 'X', // CYRILLIC CAPITAL LETTER HA
+	'\u0405': 'S', // CYRILLIC CAPITAL LETTER DZE
+	'\u0406': 'I', // CYRILLIC CAPITAL LETTER BYELORUSSIAN-UKRAINIAN I
+	'\u0408': 'J', // CYRILLIC CAPITAL LETTER JE
+	'\u04c0': 'I', // CYRILLIC LETTER PALOCHKA
+	'\u04ae': 'Y', // CYRILLIC CAPITAL LETTER STRAIGHT U
+	'\u051a': 'Q', // CYRILLIC CAPITAL LETTER QA
+	'\u051c': 'W', // CYRILLIC CAPITAL LETTER WE
+	'\u0474': 'V', // CYRILLIC CAPITAL LETTER IZHITSA
+	'\u0430': 'a', // CYRILLIC SMALL LETTER A
+	'\u0441': 'c', // CYRILLIC SMALL LETTER ES
+	'\u0435': 'e', // CYRILLIC SMALL LETTER IE
+	'\u043e': 'o', // CYRILLIC SMALL LETTER O
+	'\u0440': 'p', // CYRILLIC SMALL LETTER ER
+	'\u0445': 'x', // CYRILLIC SMALL LETTER HA
+	'\u0443': 'y', // CYRILLIC SMALL LETTER U
+	'\u0455': 's', // CYRILLIC SMALL LETTER DZE
+	'\u0456': 'i', // CYRILLIC SMALL LETTER BYELORUSSIAN-UKRAINIAN I
+	'\u0458': 'j', // CYRILLIC SMALL LETTER JE
+	'\u04bb': 'h', // CYRILLIC SMALL LETTER SHHA
+	'\u051b': 'q', // CYRILLIC SMALL LETTER QA
+	'\u051d': 'w', // CYRILLIC SMALL LETTER WE
+	'\u04cf': 'l', // CYRILLIC SMALL LETTER PALOCHKA
+	'\u04af': 'y', // CYRILLIC SMALL LETTER STRAIGHT U
+	'\u0475': 'v', // CYRILLIC SMALL LETTER IZHITSA
+	'\u0501': 'd', // CYRILLIC SMALL LETTER KOMI DE
+	'\u0261': 'g', // LATIN SMALL LETTER SCRIPT G
+	'\u0131': 'i', // LATIN SMALL LETTER DOTLESS I
+	'\u0251': 'a', // LATIN SMALL LETTER ALPHA
+	'\u0269': 'i', // LATIN SMALL LETTER IOTA
+	'\u01c0': 'l', // LATIN LETTER DENTAL CLICK
+	'\u0578': 'n', // ARMENIAN SMALL LETTER VO
+	'\u057d': 'u', // ARMENIAN SMALL LETTER SEH
+	'\u0585': 'o', // ARMENIAN SMALL LETTER OH
+	'\u0581': 'g', // ARMENIAN SMALL LETTER CO
+	'\u0570': 'h', // ARMENIAN SMALL LETTER HO
+	'\u0566': 'q', // ARMENIAN SMALL LETTER ZA
+	'\u0555': 'O', // ARMENIAN CAPITAL LETTER OH
+	'\u054d': 'U', // ARMENIAN CAPITAL LETTER SEH
+	'\u054f': 'S', // ARMENIAN CAPITAL LETTER TIWN
+	'\u053c': 'L', // ARMENIAN CAPITAL LETTER LIWN
+	'\u13aa': 'A', // CHEROKEE LETTER GO
+	'\u13f4': 'B', // CHEROKEE LETTER YV
+	'\u13df': 'C', // CHEROKEE LETTER TLI
+	'\u13a0': 'D', // CHEROKEE LETTER A
+	'\u13ac': 'E', // CHEROKEE LETTER GV
+	'\u13c0': 'G', // CHEROKEE LETTER NAH
+	'\u13bb': 'H', // CHEROKEE LETTER MI
+	'\u13ab': 'J', // CHEROKEE LETTER GU
+	'\u13e6': 'K', // CHEROKEE LETTER TSO
+	'\u13de': 'L', // CHEROKEE LETTER TLE
+	'\u13b7': 'M', // CHEROKEE LETTER LU
+	'\u13e2': 'P', // CHEROKEE LETTER TLV
+	'\u13d2': 'R', // CHEROKEE LETTER SV
+	'\u13da': 'S', // CHEROKEE LETTER DU
+	'\u13a2': 'T', // CHEROKEE LETTER I
+	'\u13d9': 'V', // CHEROKEE LETTER DO
+	'\u13b3': 'W', // CHEROKEE LETTER LA
+	'\u13c3': 'Z', // CHEROKEE LETTER NO
+}
+
+// asciiConfusables maps folded ASCII look-alikes to one of each group. Small
+// i is grouped with l, since nicks ignore case and it may be shown as I.
+var asciiConfusables = map[rune]rune{
+	'0': 'o', // DIGIT ZERO
+	'1': 'l', // DIGIT ONE
+	'i': 'l', // LATIN SMALL LETTER I
+}
+
+// ParseScripts looks up Unicode script names, such as "Cyrillic".
+func ParseScripts(names []string) ([]*unicode.RangeTable, error) {
+	scripts := make([]*unicode.RangeTable, len(names))
+	for index, name := range names {
+		for script, table := range unicode.Scripts {
+			if strings.EqualFold(script, name) {
+				scripts[index] = table
+				break
+			}
+		}
+		if scripts[index] == nil {
+			return nil, ErrNoSuchScript
+		}
+	}
+	return scripts, nil
+}
+
+func SetTrustedScripts(scripts []*unicode.RangeTable) {
+	trustedScripts = scripts
+}
+
+func isTrusted(char rune) bool {
+	for _, script := range trustedScripts {
+		if unicode.Is(script, char) {
+			return true
+		}
+	}
+	return false
+}
+
+// Skeleton is how a name looks, in the manner of a TR39 skeleton: names with
+// the same skeleton are easily mistaken for each other, e.g. Cyrillic
+// "раul" for "paul", or "pau1". The result is folded by the casemapping.
+func (name Name) Skeleton() string {
+	skeleton := strings.Map(func(char rune) rune {
+		if latin, ok := confusables[char]; ok && !isTrusted(char) {
+			return latin
+		}
+		return char
+	}, norm.NFD.String(name.String()))
+	skeleton = casemapping.Fold(norm.NFD.String(skeleton))
+	return strings.Map(func(char rune) rune {
+		if ascii, ok := asciiConfusables[char]; ok {
+			return ascii
+		}
+		return char
+	}, norm.NFD.String(skeleton))
+}
@@ -0,0 +1,56 @@
+package irc
+
+import (
+	"testing"
+	"unicode"
+)
+
+func TestSkeleton(t *testing.T) {
+	tests := []struct {
+		name    string
+		other   string
+		same    bool
+		trusted []*unicode.RangeTable
+	}{
+		{"paul", "paul", true, nil},
+		{"paul", "PAUL", true, nil},
+		{"paul", "\u0440\u0430ul", true, nil},   // Cyrillic er, a
+		{"Paul", "\u03a1aul", true, nil},        // Greek capital rho
+		{"ST", "\u13da\u13a2", true, nil},       // Cherokee du, i
+		{"#poll", "#\u0440\u043ell", true, nil}, // channel, Cyrillic er, o
+		{"jo\u00eb", "jo\u0451", true, nil},     // Latin e, Cyrillic ie, with diaeresis
+		{"jo\u00eb", "joe\u0308", true, nil},    // precomposed or not
+		{"jo\u00eb", "joe", false, nil},         // marks count
+		{"paul", "pau1", true, nil},             // digit one
+		{"Ian", "lan", true, nil},               // capital I, small l
+		{"ian", "Lan", true, nil},               // the same, by case
+		{"0scar", "Oscar", true, nil},           // digit zero
+		{"\u0399an", "1an", true, nil},          // Greek capital iota, digit one
+		{"paul", "\u0440aul", false, []*unicode.RangeTable{unicode.Cyrillic}},
+		{"Paul", "\u03a1aul", true, []*unicode.RangeTable{unicode.Cyrillic}},
+	}
+
+	defer SetTrustedScripts(nil)
+	for _, test := range tests {
+		SetTrustedScripts(test.trusted)
+		skeleton, other := Name(test.name).Skeleton(), Name(test.other).Skeleton()
+		if (skeleton == other) != test.same {
+			t.Errorf("Skeleton(%q) = %q, Skeleton(%q) = %q, expected same = %t",
+				test.name, skeleton, test.other, other, test.same)
+		}
+	}
+}
+
+func TestParseScripts(t *testing.T) {
+	scripts, err := ParseScripts([]string{"cyrillic", "Greek"})
+	if err != nil {
+		t.Fatal("ParseScripts:", err)
+	}
+	if (scripts[0] != unicode.Cyrillic) || (scripts[1] != unicode.Greek) {
+		t.Errorf("ParseScripts = %v, expected Cyrillic and Greek", scripts)
+	}
+
+	if _, err := ParseScripts([]string{"Klingon"}); err != ErrNoSuchScript {
+		t.Errorf("ParseScripts(Klingon) = %v, expected %v", err, ErrNoSuchScript)
+	}
+}
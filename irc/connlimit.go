@@ -0,0 +1,140 @@
+package irc
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_IPV4_NET        = 24
+	DEFAULT_IPV6_NET        = 64
+	DEFAULT_THROTTLE_PERIOD = time.Minute
+)
+
+var (
+	ErrTooManyClones    = errors.New("Too many connections from your host")
+	ErrTooManyNetClones = errors.New("Too many connections from your network")
+	ErrThrottled        = errors.New("Reconnecting too fast, throttled")
+)
+
+type ConnectionLimitConfig struct {
+	exempt         IPNets
+	ipv4Net        int
+	ipv6Net        int
+	perIP          uint
+	perNet         uint
+	throttle       uint
+	throttlePeriod time.Duration
+}
+
+type throttleEntry struct {
+	count uint
+	start time.Time
+}
+
+// ConnectionLimiter counts clones per address and per network, and throttles
+// how often an address may connect. Zero limits are unlimited. It is shared by
+// client goroutines, which add connections, and the server goroutine, which
+// removes them.
+type ConnectionLimiter struct {
+	byIP      map[string]uint
+	byNet     map[string]uint
+	config    *ConnectionLimitConfig
+	mutex     sync.Mutex
+	purged    time.Time
+	throttles map[string]*throttleEntry
+}
+
+func NewConnectionLimiter(config *ConnectionLimitConfig) *ConnectionLimiter {
+	return &ConnectionLimiter{
+		byIP:      make(map[string]uint),
+		byNet:     make(map[string]uint),
+		config:    config,
+		purged:    time.Now(),
+		throttles: make(map[string]*throttleEntry),
+	}
+}
+
+func (limiter *ConnectionLimiter) netKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(limiter.config.ipv4Net, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(limiter.config.ipv6Net, 128)).String()
+}
+
+// Add counts a new connection or explains why it is refused. Exempt addresses
+// are counted but never refused.
+func (limiter *ConnectionLimiter) Add(ip net.IP) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	config := limiter.config
+	ipKey, netKey := ip.String(), limiter.netKey(ip)
+	exempt := config.exempt.Contains(ip)
+
+	if !exempt && (config.throttle > 0) && limiter.throttled(ipKey) {
+		return ErrThrottled
+	}
+	if !exempt && (config.perIP > 0) && (limiter.byIP[ipKey] >= config.perIP) {
+		return ErrTooManyClones
+	}
+	if !exempt && (config.perNet > 0) && (limiter.byNet[netKey] >= config.perNet) {
+		return ErrTooManyNetClones
+	}
+
+	limiter.byIP[ipKey] += 1
+	limiter.byNet[netKey] += 1
+	return nil
+}
+
+// Count counts a connection that was accepted before, e.g. one kept across an
+// upgrade. It is never refused.
+func (limiter *ConnectionLimiter) Count(ip net.IP) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.byIP[ip.String()] += 1
+	limiter.byNet[limiter.netKey(ip)] += 1
+}
+
+func (limiter *ConnectionLimiter) Remove(ip net.IP) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	ipKey, netKey := ip.String(), limiter.netKey(ip)
+	if limiter.byIP[ipKey] <= 1 {
+		delete(limiter.byIP, ipKey)
+	} else {
+		limiter.byIP[ipKey] -= 1
+	}
+	if limiter.byNet[netKey] <= 1 {
+		delete(limiter.byNet, netKey)
+	} else {
+		limiter.byNet[netKey] -= 1
+	}
+}
+
+// throttled records a connection attempt and reports whether the address has
+// used up its attempts for the current period.
+func (limiter *ConnectionLimiter) throttled(ipKey string) bool {
+	now := time.Now()
+	period := limiter.config.throttlePeriod
+	if now.Sub(limiter.purged) > period {
+		for key, entry := range limiter.throttles {
+			if now.Sub(entry.start) > period {
+				delete(limiter.throttles, key)
+			}
+		}
+		limiter.purged = now
+	}
+
+	entry := limiter.throttles[ipKey]
+	if (entry == nil) || (now.Sub(entry.start) > period) {
+		entry = &throttleEntry{start: now}
+		limiter.throttles[ipKey] = entry
+	}
+	entry.count += 1
+	return entry.count > limiter.config.throttle
+}
@@ -6,38 +6,53 @@ const (
 	MAX_REPLY_LEN = 512 - len(CRLF)
 
 	// string codes
-	AWAY    StringCode = "AWAY"
-	CAP     StringCode = "CAP"
-	DEBUG   StringCode = "DEBUG"
-	ERROR   StringCode = "ERROR"
-	INVITE  StringCode = "INVITE"
-	ISON    StringCode = "ISON"
-	JOIN    StringCode = "JOIN"
-	KICK    StringCode = "KICK"
-	KILL    StringCode = "KILL"
-	LIST    StringCode = "LIST"
-	MODE    StringCode = "MODE"
-	MOTD    StringCode = "MOTD"
-	NAMES   StringCode = "NAMES"
-	NICK    StringCode = "NICK"
-	NOTICE  StringCode = "NOTICE"
-	ONICK   StringCode = "ONICK"
-	OPER    StringCode = "OPER"
-	PART    StringCode = "PART"
-	PASS    StringCode = "PASS"
-	PING    StringCode = "PING"
-	PONG    StringCode = "PONG"
-	PRIVMSG StringCode = "PRIVMSG"
-	PROXY   StringCode = "PROXY"
-	QUIT    StringCode = "QUIT"
-	THEATER StringCode = "THEATER" // nonstandard
-	TIME    StringCode = "TIME"
-	TOPIC   StringCode = "TOPIC"
-	USER    StringCode = "USER"
-	VERSION StringCode = "VERSION"
-	WHO     StringCode = "WHO"
-	WHOIS   StringCode = "WHOIS"
-	WHOWAS  StringCode = "WHOWAS"
+	ACCOUNT      StringCode = "ACCOUNT"
+	AUTHENTICATE StringCode = "AUTHENTICATE"
+	AWAY         StringCode = "AWAY"
+	CAP          StringCode = "CAP"
+	DEBUG        StringCode = "DEBUG"
+	DIE          StringCode = "DIE"
+	DLINE        StringCode = "DLINE"
+	ERROR        StringCode = "ERROR"
+	INVITE       StringCode = "INVITE"
+	ISON         StringCode = "ISON"
+	JOIN         StringCode = "JOIN"
+	KICK         StringCode = "KICK"
+	KILL         StringCode = "KILL"
+	KLINE        StringCode = "KLINE"
+	LIST         StringCode = "LIST"
+	MODE         StringCode = "MODE"
+	MOTD         StringCode = "MOTD"
+	NAMES        StringCode = "NAMES"
+	NICK         StringCode = "NICK"
+	NOTICE       StringCode = "NOTICE"
+	ONICK        StringCode = "ONICK"
+	OPER         StringCode = "OPER"
+	PART         StringCode = "PART"
+	PASS         StringCode = "PASS"
+	PING         StringCode = "PING"
+	PONG         StringCode = "PONG"
+	PRIVMSG      StringCode = "PRIVMSG"
+	PROXY        StringCode = "PROXY"
+	QUIT         StringCode = "QUIT"
+	REHASH       StringCode = "REHASH"
+	RESTART      StringCode = "RESTART"
+	STATS        StringCode = "STATS"
+	TAGMSG       StringCode = "TAGMSG"
+	THEATER      StringCode = "THEATER" // nonstandard
+	TIME         StringCode = "TIME"
+	TOPIC        StringCode = "TOPIC"
+	UNDLINE      StringCode = "UNDLINE"
+	UNKLINE      StringCode = "UNKLINE"
+	USER         StringCode = "USER"
+	VERSION      StringCode = "VERSION"
+	WHO          StringCode = "WHO"
+	WHOIS        StringCode = "WHOIS"
+	WHOWAS       StringCode = "WHOWAS"
+
+	// internal string codes, never parsed from client input
+	BCRYPT      StringCode = "BCRYPT"
+	NICKPROTECT StringCode = "NICKPROTECT"
 
 	// numeric codes
 	RPL_WELCOME           NumericCode = 1
@@ -45,6 +60,7 @@ const (
 	RPL_CREATED           NumericCode = 3
 	RPL_MYINFO            NumericCode = 4
 	RPL_BOUNCE            NumericCode = 5
+	RPL_ISUPPORT          NumericCode = 5
 	RPL_TRACELINK         NumericCode = 200
 	RPL_TRACECONNECTING   NumericCode = 201
 	RPL_TRACEHANDSHAKE    NumericCode = 202
@@ -58,8 +74,10 @@ const (
 	RPL_TRACERECONNECT    NumericCode = 210
 	RPL_STATSLINKINFO     NumericCode = 211
 	RPL_STATSCOMMANDS     NumericCode = 212
+	RPL_STATSKLINE        NumericCode = 216
 	RPL_ENDOFSTATS        NumericCode = 219
 	RPL_UMODEIS           NumericCode = 221
+	RPL_STATSDLINE        NumericCode = 225
 	RPL_SERVLIST          NumericCode = 234
 	RPL_SERVLISTEND       NumericCode = 235
 	RPL_STATSUPTIME       NumericCode = 242
@@ -76,6 +94,7 @@ const (
 	RPL_TRACELOG          NumericCode = 261
 	RPL_TRACEEND          NumericCode = 262
 	RPL_TRYAGAIN          NumericCode = 263
+	RPL_WHOISCERTFP       NumericCode = 276
 	RPL_AWAY              NumericCode = 301
 	RPL_USERHOST          NumericCode = 302
 	RPL_ISON              NumericCode = 303
@@ -89,6 +108,7 @@ const (
 	RPL_WHOISIDLE         NumericCode = 317
 	RPL_ENDOFWHOIS        NumericCode = 318
 	RPL_WHOISCHANNELS     NumericCode = 319
+	RPL_WHOISACCOUNT      NumericCode = 330
 	RPL_LIST              NumericCode = 322
 	RPL_LISTEND           NumericCode = 323
 	RPL_CHANNELMODEIS     NumericCode = 324
@@ -123,6 +143,7 @@ const (
 	RPL_USERS             NumericCode = 393
 	RPL_ENDOFUSERS        NumericCode = 394
 	RPL_NOUSERS           NumericCode = 395
+	RPL_HOSTHIDDEN        NumericCode = 396
 	ERR_NOSUCHNICK        NumericCode = 401
 	ERR_NOSUCHSERVER      NumericCode = 402
 	ERR_NOSUCHCHANNEL     NumericCode = 403
@@ -138,6 +159,7 @@ const (
 	ERR_NOTOPLEVEL        NumericCode = 413
 	ERR_WILDTOPLEVEL      NumericCode = 414
 	ERR_BADMASK           NumericCode = 415
+	ERR_INPUTTOOLONG      NumericCode = 417
 	ERR_UNKNOWNCOMMAND    NumericCode = 421
 	ERR_NOMOTD            NumericCode = 422
 	ERR_NOADMININFO       NumericCode = 423
@@ -177,4 +199,13 @@ const (
 	ERR_NOOPERHOST        NumericCode = 491
 	ERR_UMODEUNKNOWNFLAG  NumericCode = 501
 	ERR_USERSDONTMATCH    NumericCode = 502
+	RPL_LOGGEDIN          NumericCode = 900
+	RPL_LOGGEDOUT         NumericCode = 901
+	ERR_NICKLOCKED        NumericCode = 902
+	RPL_SASLSUCCESS       NumericCode = 903
+	ERR_SASLFAIL          NumericCode = 904
+	ERR_SASLTOOLONG       NumericCode = 905
+	ERR_SASLABORTED       NumericCode = 906
+	ERR_SASLALREADY       NumericCode = 907
+	RPL_SASLMECHS         NumericCode = 908
 )
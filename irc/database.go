@@ -2,26 +2,249 @@ package irc
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"io"
 	"log"
 	"os"
 )
 
-func InitDB(path string) {
-	os.Remove(path)
-	db := OpenDB(path)
-	defer db.Close()
-	_, err := db.Exec(`
-        CREATE TABLE channel (
+var (
+	ErrDatabaseExists = errors.New("database exists; use upgradedb")
+	ErrSchemaTooNew   = errors.New("database schema is newer than this server")
+	ErrSchemaTooOld   = errors.New("database schema is out of date; run upgradedb")
+
+	ErrCasemappingChanged = errors.New("casemapping differs from the database's")
+)
+
+// Migration moves the schema from version-1 to version. Migrations are run in
+// order, each in its own transaction.
+type Migration struct {
+	version     int
+	description string
+	stmts       []string
+}
+
+var migrations = []*Migration{
+	{1, "channels", []string{
+		`CREATE TABLE channel (
           name TEXT NOT NULL UNIQUE,
           flags TEXT DEFAULT '',
           key TEXT DEFAULT '',
           topic TEXT DEFAULT '',
-          user_limit INTEGER DEFAULT 0,
-          ban_list TEXT DEFAULT '',
-          except_list TEXT DEFAULT '',
-          invite_list TEXT DEFAULT '')`)
+          user_limit INTEGER DEFAULT 0)`,
+	}},
+	{2, "channel ban, except and invite lists", []string{
+		`ALTER TABLE channel ADD COLUMN ban_list TEXT DEFAULT ''`,
+		`ALTER TABLE channel ADD COLUMN except_list TEXT DEFAULT ''`,
+		`ALTER TABLE channel ADD COLUMN invite_list TEXT DEFAULT ''`,
+	}},
+	// Tables from here on were created by the old upgradedb, which did not
+	// record a version, so they may already exist.
+	{3, "accounts", []string{
+		`CREATE TABLE IF NOT EXISTS account (
+          key TEXT NOT NULL UNIQUE,
+          name TEXT NOT NULL,
+          password TEXT NOT NULL,
+          certfp TEXT DEFAULT '',
+          created INTEGER NOT NULL)`,
+	}},
+	{4, "k-lines and d-lines", []string{
+		`CREATE TABLE IF NOT EXISTS ban (
+          kind TEXT NOT NULL,
+          mask TEXT NOT NULL,
+          reason TEXT DEFAULT '',
+          oper TEXT DEFAULT '',
+          created INTEGER NOT NULL,
+          expires INTEGER DEFAULT 0,
+          UNIQUE (kind, mask) ON CONFLICT REPLACE)`,
+	}},
+	{5, "channel access", []string{
+		`CREATE TABLE IF NOT EXISTS channel_access (
+          channel TEXT NOT NULL,
+          account TEXT NOT NULL,
+          level TEXT NOT NULL,
+          UNIQUE (channel, account) ON CONFLICT REPLACE)`,
+	}},
+	// SASL EXTERNAL needs a certificate to name one account. The oldest
+	// account keeps a shared certificate.
+	{6, "unique account certificates", []string{
+		`UPDATE account SET certfp = ''
+          WHERE certfp != '' AND rowid NOT IN (
+            SELECT MIN(rowid) FROM account WHERE certfp != '' GROUP BY certfp)`,
+		`CREATE UNIQUE INDEX account_certfp ON account (certfp)
+          WHERE certfp != ''`,
+	}},
+	// Stored names were folded with precis before the casemapping could be
+	// configured. initdb records the configured one instead.
+	{7, "casemapping", []string{
+		`CREATE TABLE setting (
+          name TEXT NOT NULL UNIQUE,
+          value TEXT NOT NULL)`,
+		`INSERT INTO setting (name, value) VALUES ('casemapping', 'precis')`,
+	}},
+}
+
+func SchemaLatest() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion reads the schema_version table. Databases from before it
+// existed are recognized by their channel table.
+func SchemaVersion(db *sql.DB) (version int, err error) {
+	hasVersion, err := hasTable(db, "schema_version")
+	if err != nil {
+		return
+	}
+	if hasVersion {
+		err = db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+		return
+	}
+
+	hasChannel, err := hasTable(db, "channel")
+	if (err != nil) || !hasChannel {
+		return
+	}
+	// The lists came with the old upgradedb's ALTER TABLE.
+	if _, err := db.Exec(`SELECT ban_list FROM channel LIMIT 0`); err != nil {
+		return 1, nil
+	}
+	return 2, nil
+}
+
+func hasTable(db *sql.DB, name string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+        WHERE type = 'table' AND name = ?`, name).Scan(&count)
+	return count > 0, err
+}
+
+// CheckSchema fails unless the database is at the version this server
+// expects.
+func CheckSchema(db *sql.DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version > SchemaLatest():
+		return ErrSchemaTooNew
+	case version < SchemaLatest():
+		return ErrSchemaTooOld
+	}
+	return nil
+}
+
+func (migration *Migration) Apply(db *sql.DB) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, stmt := range migration.stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return
+		}
+	}
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`,
+		`DELETE FROM schema_version`,
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return
+		}
+	}
+	if _, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`,
+		migration.version); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// Migrate applies the migrations past the database's version.
+func Migrate(db *sql.DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > SchemaLatest() {
+		return ErrSchemaTooNew
+	}
+	for _, migration := range migrations {
+		if migration.version <= version {
+			continue
+		}
+		if err := migration.Apply(db); err != nil {
+			return fmt.Errorf("migration %d (%s): %s", migration.version,
+				migration.description, err)
+		}
+		log.Printf("database migrated to %d: %s", migration.version,
+			migration.description)
+	}
+	return nil
+}
+
+// BackupDB copies the database file beside itself, named for its schema
+// version. A backup left by an earlier, failed upgrade at the same version is
+// kept; the server refuses an out-of-date database, so it cannot have changed.
+func BackupDB(path string, version int) (backup string, err error) {
+	backup = fmt.Sprintf("%s.v%d.bak", path, version)
+	if _, err = os.Stat(backup); err == nil {
+		return
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	// The copy is renamed into place, so a backup is never partial.
+	temp := backup + ".tmp"
+	dst, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	if _, err = io.Copy(dst, src); err != nil {
+		return
+	}
+	if err = dst.Sync(); err != nil {
+		return
+	}
+	err = os.Rename(temp, backup)
+	return
+}
+
+// CheckCasemapping fails unless the database's names were folded with
+// mapping. Lookups would miss them otherwise.
+func CheckCasemapping(db *sql.DB, mapping Casemapping) (stored Casemapping, err error) {
+	err = db.QueryRow(`SELECT value FROM setting
+        WHERE name = 'casemapping'`).Scan(&stored)
+	if (err == nil) && (stored != mapping) {
+		err = ErrCasemappingChanged
+	}
+	return
+}
+
+// InitDB creates a database whose names are folded with mapping.
+func InitDB(path string, mapping Casemapping) {
+	if _, err := os.Stat(path); err == nil {
+		log.Fatal("initdb error: ", ErrDatabaseExists)
+	}
+	db := OpenDB(path)
+	defer db.Close()
+	if err := Migrate(db); err != nil {
+		log.Fatal("initdb error: ", err)
+	}
+	_, err := db.Exec(`UPDATE setting SET value = ?
+        WHERE name = 'casemapping'`, string(mapping))
 	if err != nil {
 		log.Fatal("initdb error: ", err)
 	}
@@ -29,13 +252,27 @@ func InitDB(path string) {
 
 func UpgradeDB(path string) {
 	db := OpenDB(path)
-	alter := `ALTER TABLE channel ADD COLUMN %s TEXT DEFAULT ''`
-	cols := []string{"ban_list", "except_list", "invite_list"}
-	for _, col := range cols {
-		_, err := db.Exec(fmt.Sprintf(alter, col))
+	defer db.Close()
+	version, err := SchemaVersion(db)
+	if err != nil {
+		log.Fatal("upgradedb error: ", err)
+	}
+	switch {
+	case version > SchemaLatest():
+		log.Fatal("upgradedb error: ", ErrSchemaTooNew)
+
+	case version == SchemaLatest():
+		return
+
+	case version > 0:
+		backup, err := BackupDB(path, version)
 		if err != nil {
-			log.Fatal("updatedb error: ", err)
+			log.Fatal("backup error: ", err)
 		}
+		log.Println("database backed up: ", backup)
+	}
+	if err := Migrate(db); err != nil {
+		log.Fatal("upgradedb error: ", err)
 	}
 }
 
@@ -0,0 +1,227 @@
+package irc
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) (db *sql.DB, path string) {
+	path = filepath.Join(t.TempDir(), "test.db")
+	db = OpenDB(path)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return
+}
+
+func execAll(t *testing.T, db *sql.DB, stmts []string) {
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+}
+
+func checkVersion(t *testing.T, db *sql.DB, expected int) {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal("SchemaVersion:", err)
+	}
+	if version != expected {
+		t.Errorf("SchemaVersion = %d, expected %d", version, expected)
+	}
+}
+
+func TestMigrateFresh(t *testing.T) {
+	db, _ := openTestDB(t)
+	checkVersion(t, db, 0)
+	if err := CheckSchema(db); err != ErrSchemaTooOld {
+		t.Errorf("CheckSchema = %v, expected %v", err, ErrSchemaTooOld)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	checkVersion(t, db, SchemaLatest())
+	if err := CheckSchema(db); err != nil {
+		t.Error("CheckSchema:", err)
+	}
+
+	// Migrating again changes nothing.
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	checkVersion(t, db, SchemaLatest())
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	// Databases from before schema_version, as left by the old initdb and
+	// upgradedb.
+	legacyAccount := `CREATE TABLE account (
+          key TEXT NOT NULL UNIQUE,
+          name TEXT NOT NULL,
+          password TEXT NOT NULL,
+          certfp TEXT DEFAULT '',
+          created INTEGER NOT NULL)`
+	tests := []struct {
+		name    string
+		version int
+		stmts   []string
+	}{
+		{"initdb", 1, migrations[0].stmts},
+		{"upgradedb", 2, append(append(append([]string{},
+			migrations[0].stmts...), migrations[1].stmts...), legacyAccount)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, _ := openTestDB(t)
+			execAll(t, db, test.stmts)
+			execAll(t, db, []string{
+				`INSERT INTO channel (name, topic) VALUES ('#kept', 'hello')`,
+			})
+			checkVersion(t, db, test.version)
+
+			if err := Migrate(db); err != nil {
+				t.Fatal("Migrate:", err)
+			}
+			checkVersion(t, db, SchemaLatest())
+
+			var topic, banList string
+			err := db.QueryRow(`SELECT topic, ban_list FROM channel
+                WHERE name = '#kept'`).Scan(&topic, &banList)
+			if err != nil {
+				t.Fatal("channel:", err)
+			}
+			if (topic != "hello") || (banList != "") {
+				t.Errorf("channel = %q, %q, expected %q, %q", topic, banList, "hello", "")
+			}
+		})
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	db, _ := openTestDB(t)
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	execAll(t, db, []string{`UPDATE schema_version SET version = version + 1`})
+
+	if err := CheckSchema(db); err != ErrSchemaTooNew {
+		t.Errorf("CheckSchema = %v, expected %v", err, ErrSchemaTooNew)
+	}
+	if err := Migrate(db); err != ErrSchemaTooNew {
+		t.Errorf("Migrate = %v, expected %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestMigrateRetry(t *testing.T) {
+	db, path := openTestDB(t)
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	latest := SchemaLatest()
+
+	saved := migrations
+	defer func() {
+		migrations = saved
+	}()
+	migrations = append(append([]*Migration{}, saved...), &Migration{
+		latest + 1, "broken", []string{
+			`CREATE TABLE half_done (id INTEGER)`,
+			`NOT SQL`,
+		},
+	})
+
+	// As upgradedb does it, twice.
+	var backups []string
+	for attempt := 1; attempt <= 2; attempt++ {
+		backup, err := BackupDB(path, latest)
+		if err != nil {
+			t.Fatalf("attempt %d: BackupDB: %s", attempt, err)
+		}
+		if _, err := os.Stat(backup); err != nil {
+			t.Fatalf("attempt %d: backup: %s", attempt, err)
+		}
+		backups = append(backups, backup)
+
+		if err := Migrate(db); err == nil {
+			t.Fatalf("attempt %d: Migrate succeeded", attempt)
+		}
+		checkVersion(t, db, latest)
+		if exists, _ := hasTable(db, "half_done"); exists {
+			t.Fatalf("attempt %d: broken migration was not rolled back", attempt)
+		}
+	}
+	if backups[0] != backups[1] {
+		t.Errorf("backups %s and %s differ", backups[0], backups[1])
+	}
+
+	migrations[len(migrations)-1].stmts = []string{
+		`CREATE TABLE half_done (id INTEGER)`,
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	checkVersion(t, db, latest+1)
+}
+
+func TestMigrateCertFP(t *testing.T) {
+	db, _ := openTestDB(t)
+	saved := migrations
+	migrations = saved[:5]
+	err := Migrate(db)
+	migrations = saved
+	if err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	execAll(t, db, []string{
+		`INSERT INTO account (key, name, password, certfp, created)
+          VALUES ('a', 'a', '', 'shared', 1), ('b', 'b', '', 'shared', 2),
+            ('c', 'c', '', '', 3), ('d', 'd', '', '', 4)`,
+	})
+
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	var keys string
+	err = db.QueryRow(`SELECT GROUP_CONCAT(key) FROM account
+        WHERE certfp = 'shared'`).Scan(&keys)
+	if err != nil {
+		t.Fatal("account:", err)
+	}
+	if keys != "a" {
+		t.Errorf("certificate is on %s, expected a", keys)
+	}
+
+	_, err = db.Exec(`UPDATE account SET certfp = 'shared' WHERE key = 'b'`)
+	if err == nil {
+		t.Error("certificate shared after migration")
+	}
+}
+
+func TestCheckCasemapping(t *testing.T) {
+	db, _ := openTestDB(t)
+	if err := Migrate(db); err != nil {
+		t.Fatal("Migrate:", err)
+	}
+	// Upgraded databases were folded with precis.
+	if _, err := CheckCasemapping(db, CasemappingPrecis); err != nil {
+		t.Error("CheckCasemapping(precis):", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ascii.db")
+	InitDB(path, CasemappingASCII)
+	db = OpenDB(path)
+	defer db.Close()
+	if _, err := CheckCasemapping(db, CasemappingASCII); err != nil {
+		t.Error("CheckCasemapping(ascii):", err)
+	}
+	stored, err := CheckCasemapping(db, CasemappingPrecis)
+	if (err != ErrCasemappingChanged) || (stored != CasemappingASCII) {
+		t.Errorf("CheckCasemapping(precis) = %s, %v, expected %s, %v",
+			stored, err, CasemappingASCII, ErrCasemappingChanged)
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 func (msg *DebugCommand) HandleServer(server *Server) {
 	client := msg.Client()
-	if !client.flags[Operator] {
+	if !client.HasPrivilege(PrivDebug) {
 		return
 	}
 
@@ -61,8 +61,28 @@ func (msg *DebugCommand) HandleServer(server *Server) {
 
 		server.Replyf(client, "CPU profile writing to %s", profFile)
 
+	case "SENDQ":
+		if msg.target != "" {
+			target := server.clients.Get(msg.target)
+			if target == nil {
+				client.ErrNoSuchNick(msg.target)
+				break
+			}
+			server.ReplySendQ(client, target)
+			break
+		}
+		for _, target := range server.clients.byNick {
+			server.ReplySendQ(client, target)
+		}
+
 	case "STOPCPUPROFILE":
 		pprof.StopCPUProfile()
 		server.Reply(client, "CPU profiling stopped")
 	}
 }
+
+func (server *Server) ReplySendQ(client *Client, target *Client) {
+	length, lines := target.socket.SendQ()
+	server.Replyf(client, "sendq %s: %d bytes, %d lines (max %d)",
+		target.Nick(), length, lines, target.socket.sendQMax)
+}
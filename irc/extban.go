@@ -0,0 +1,143 @@
+package irc
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	EXTBAN_PREFIX = "$"  // starts an extended ban
+	EXTBAN_TYPES  = "ar" // advertised in ISUPPORT EXTBAN
+	MUTE_PREFIX   = "m:" // the rest of the mask may talk, not join
+)
+
+var (
+	ErrBadExtBan = errors.New("bad extban")
+)
+
+type ExtBanType rune
+
+const (
+	ExtBanAccount  ExtBanType = 'a' // $a matches any account, $a:<glob> one
+	ExtBanRealname ExtBanType = 'r' // $r:<glob>
+)
+
+// ExtBan matches something other than the hostmask, written
+// $[~]<type>[:<glob>]. A `~` inverts the match, so $~a is everyone who is
+// not logged in.
+type ExtBan struct {
+	negate     bool
+	extBanType ExtBanType
+	regexp     *regexp.Regexp // nil matches any non-empty value
+}
+
+func IsExtBan(mask Name) bool {
+	return strings.HasPrefix(mask.String(), EXTBAN_PREFIX)
+}
+
+func ParseExtBan(mask Name) (*ExtBan, error) {
+	str := strings.TrimPrefix(mask.String(), EXTBAN_PREFIX)
+	extBan := &ExtBan{}
+	if strings.HasPrefix(str, "~") {
+		extBan.negate = true
+		str = str[len("~"):]
+	}
+	if str == "" {
+		return nil, ErrBadExtBan
+	}
+
+	extBan.extBanType = ExtBanType(str[0])
+	switch extBan.extBanType {
+	case ExtBanAccount, ExtBanRealname:
+	default:
+		return nil, ErrBadExtBan
+	}
+
+	str = str[1:]
+	if strings.HasPrefix(str, ":") {
+		expr := "^" + globExpr(casemapping.Fold(str[len(":"):])) + "$"
+		var err error
+		if extBan.regexp, err = regexp.Compile(expr); err != nil {
+			return nil, err
+		}
+	} else if (str != "") || (extBan.extBanType == ExtBanRealname) {
+		return nil, ErrBadExtBan
+	}
+	return extBan, nil
+}
+
+func (extBan *ExtBan) Match(client *Client) bool {
+	var value string
+	switch extBan.extBanType {
+	case ExtBanAccount:
+		value = client.account.String()
+
+	case ExtBanRealname:
+		value = client.realname.String()
+	}
+
+	var matched bool
+	if extBan.regexp == nil {
+		matched = value != ""
+	} else {
+		matched = extBan.regexp.MatchString(casemapping.Fold(value))
+	}
+	return matched != extBan.negate
+}
+
+// IsValidMask reports whether a list mask can be matched: any hostmask, or
+// an extban, optionally behind the mute prefix.
+func IsValidMask(mask Name) bool {
+	mask = Name(strings.TrimPrefix(mask.String(), MUTE_PREFIX))
+	if mask == "" {
+		return false
+	}
+	if IsExtBan(mask) {
+		_, err := ParseExtBan(mask)
+		return err == nil
+	}
+	return true
+}
+
+// maskMatcher matches clients against some hostmasks, compiled into one
+// regexp, and some extbans. Both sides are folded by the casemapping.
+type maskMatcher struct {
+	extBans []*ExtBan
+	regexp  *regexp.Regexp
+}
+
+func newMaskMatcher(masks []Name) *maskMatcher {
+	matcher := &maskMatcher{}
+	maskExprs := make([]string, 0, len(masks))
+	for _, mask := range masks {
+		if !IsExtBan(mask) {
+			maskExprs = append(maskExprs, globExpr(mask.ToLower().String()))
+			continue
+		}
+		extBan, err := ParseExtBan(mask)
+		if err != nil {
+			Log.debug.Println("newMaskMatcher:", mask, err)
+			continue
+		}
+		matcher.extBans = append(matcher.extBans, extBan)
+	}
+	if len(maskExprs) > 0 {
+		expr := "^(" + strings.Join(maskExprs, "|") + ")$"
+		matcher.regexp, _ = regexp.Compile(expr)
+	}
+	return matcher
+}
+
+func (matcher *maskMatcher) Match(client *Client) bool {
+	if (matcher.regexp != nil) &&
+		matcher.regexp.MatchString(client.UserHost().ToLower().String()) {
+		return true
+	}
+	for _, extBan := range matcher.extBans {
+		if extBan.Match(client) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package irc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FLOOD_BURST = 5  // commands accepted at once
+	DEFAULT_FLOOD_RATE  = 2  // commands per second after the burst
+	DEFAULT_FLOOD_LIMIT = 30 // consecutive delayed commands before disconnect
+)
+
+var (
+	ErrExcessFlood = errors.New("Excess Flood")
+)
+
+type FakelagConfig struct {
+	burst  float64
+	exempt IPNets
+	limit  uint
+	rate   float64
+}
+
+// Fakelag is a token bucket for client input. Commands past the burst are
+// delayed on the client goroutine until a token is available; a client whose
+// commands keep arriving faster than the rate is flooding.
+type Fakelag struct {
+	config  *FakelagConfig
+	exempt  bool
+	lagged  uint
+	mutex   sync.Mutex
+	oper    bool
+	tokens  float64
+	touched time.Time
+}
+
+func NewFakelag(config *FakelagConfig) *Fakelag {
+	return &Fakelag{
+		config:  config,
+		tokens:  config.burst,
+		touched: time.Now(),
+	}
+}
+
+// SetExempt is called from the client goroutine once the real address is known.
+func (lag *Fakelag) SetExempt(exempt bool) {
+	lag.mutex.Lock()
+	defer lag.mutex.Unlock()
+	lag.exempt = exempt
+}
+
+// SetOper is called from the server goroutine when operator status changes.
+func (lag *Fakelag) SetOper(oper bool) {
+	lag.mutex.Lock()
+	defer lag.mutex.Unlock()
+	lag.oper = oper
+}
+
+// Touch accounts for one command and returns how long to hold it.
+func (lag *Fakelag) Touch() (delay time.Duration, err error) {
+	lag.mutex.Lock()
+	defer lag.mutex.Unlock()
+
+	if lag.exempt || lag.oper {
+		return
+	}
+
+	now := time.Now()
+	lag.tokens += now.Sub(lag.touched).Seconds() * lag.config.rate
+	if lag.tokens > lag.config.burst {
+		lag.tokens = lag.config.burst
+	}
+	lag.touched = now
+
+	lag.tokens -= 1
+	if lag.tokens >= 0 {
+		lag.lagged = 0
+		return
+	}
+
+	lag.lagged += 1
+	if lag.lagged > lag.config.limit {
+		err = ErrExcessFlood
+		return
+	}
+	delay = time.Duration(-lag.tokens / lag.config.rate * float64(time.Second))
+	return
+}
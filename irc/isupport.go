@@ -0,0 +1,85 @@
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ISUPPORT_MAX_TOKENS = 13 // per RPL_ISUPPORT line
+)
+
+// ISupport holds the RPL_ISUPPORT (005) tokens sent after registration and
+// for VERSION. A token with an empty value is sent bare.
+type ISupport map[string]string
+
+func (isupport ISupport) Add(name string, value interface{}) {
+	isupport[name] = fmt.Sprint(value)
+}
+
+func (isupport ISupport) Tokens() []string {
+	tokens := make([]string, 0, len(isupport))
+	for name, value := range isupport {
+		if value == "" {
+			tokens = append(tokens, name)
+		} else {
+			tokens = append(tokens, name+"="+value)
+		}
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// chanModesString is the CHANMODES value: list modes, modes that always take
+// an argument, modes that take one when set, and flags.
+func chanModesString(modes ChannelModes) string {
+	var lists, always, whenSet, flags ChannelModes
+	for _, mode := range modes {
+		switch mode {
+		case BanMask, ExceptMask, InviteMask:
+			lists = append(lists, mode)
+
+		case Key:
+			always = append(always, mode)
+
+		case UserLimit:
+			whenSet = append(whenSet, mode)
+
+		default:
+			flags = append(flags, mode)
+		}
+	}
+	return strings.Join([]string{lists.String(), always.String(),
+		whenSet.String(), flags.String()}, ",")
+}
+
+func NewISupport(limits *Limits) ISupport {
+	isupport := make(ISupport)
+	isupport.Add("CASEMAPPING", casemapping.ISupportString())
+	isupport.Add("CHANLIMIT", fmt.Sprintf("%s:%d", CHANTYPES, limits.channels))
+	isupport.Add("CHANMODES", chanModesString(SupportedChannelModes))
+	isupport.Add("CHANNELLEN", limits.channelLen)
+	isupport.Add("CHANTYPES", CHANTYPES)
+	isupport.Add("EXCEPTS", ExceptMask)
+	isupport.Add("EXTBAN", EXTBAN_PREFIX+","+EXTBAN_TYPES)
+	isupport.Add("INVEX", InviteMask)
+	isupport.Add("MAXLIST", fmt.Sprintf("%s%s%s:%d", BanMask, ExceptMask, InviteMask,
+		limits.maxList))
+	isupport.Add("NICKLEN", limits.nickLen)
+	isupport.Add("PREFIX", fmt.Sprintf("(%s%s)@+", ChannelOperator, Voice))
+	isupport.Add("TOPICLEN", limits.topicLen)
+	return isupport
+}
+
+func (target *Client) RplISupport() {
+	tokens := target.server.isupport.Tokens()
+	for from := 0; from < len(tokens); from += ISUPPORT_MAX_TOKENS {
+		to := from + ISUPPORT_MAX_TOKENS
+		if to > len(tokens) {
+			to = len(tokens)
+		}
+		target.MultilineReply(tokens[from:to], RPL_ISUPPORT,
+			"%s :are supported by this server")
+	}
+}
@@ -0,0 +1,47 @@
+package irc
+
+import (
+	"unicode/utf8"
+)
+
+const (
+	DEFAULT_CHANNELLEN = 64 // including the type character
+	DEFAULT_CHANLIMIT  = 100
+	DEFAULT_MAXLIST    = 100
+	DEFAULT_NICKLEN    = 32
+	DEFAULT_TOPICLEN   = 390
+)
+
+// Limits are the protocol limits from the `limits` section. Nick and
+// channel lengths count characters; topic length counts bytes, since it
+// has to fit in a line.
+type Limits struct {
+	channelLen uint
+	channels   uint // joined by one client
+	maxList    uint // entries in each of a channel's +b, +e and +I lists
+	nickLen    uint
+	topicLen   uint
+}
+
+func (limits *Limits) IsNickname(name Name) bool {
+	return name.IsNickname() &&
+		(uint(utf8.RuneCountInString(name.String())) <= limits.nickLen)
+}
+
+func (limits *Limits) IsChannel(name Name) bool {
+	return name.IsChannel() &&
+		(uint(utf8.RuneCountInString(name.String())) <= limits.channelLen)
+}
+
+// TruncateTopic cuts a topic to the limit without splitting a character.
+func (limits *Limits) TruncateTopic(topic Text) Text {
+	if uint(len(topic)) <= limits.topicLen {
+		return topic
+	}
+	// Back up to the start of the character spanning the cut, if any.
+	str, end := topic.String(), int(limits.topicLen)
+	for i := 0; (i < utf8.UTFMax) && (end > 0) && !utf8.RuneStart(str[end]); i++ {
+		end--
+	}
+	return Text(str[:end])
+}
@@ -90,8 +90,8 @@ const (
 
 var (
 	SupportedChannelModes = ChannelModes{
-		BanMask, ExceptMask, InviteMask, InviteOnly, Key, NoOutside,
-		OpOnlyTopic, Persistent, Private, Theater, UserLimit,
+		BanMask, ExceptMask, InviteMask, InviteOnly, Key, Moderated,
+		NoOutside, OpOnlyTopic, Persistent, Private, Theater, UserLimit,
 	}
 )
 
@@ -108,7 +108,7 @@ func (m *ModeCommand) HandleServer(s *Server) {
 		return
 	}
 
-	if client != target && !client.flags[Operator] {
+	if client != target && !client.HasPrivilege(PrivSAMode) {
 		client.ErrUsersDontMatch()
 		return
 	}
@@ -140,6 +140,9 @@ func (m *ModeCommand) HandleServer(s *Server) {
 					continue
 				}
 				delete(target.flags, change.mode)
+				if change.mode == Operator {
+					target.fakelag.SetOper(false)
+				}
 				changes = append(changes, change)
 			}
 		}
@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"fmt"
 	"net"
 	"strings"
 )
@@ -27,3 +28,48 @@ func LookupHostname(addr Name) Name {
 	hostname := strings.TrimSuffix(names[0], ".")
 	return Name(hostname)
 }
+
+// AddrIP extracts the IP address of a TCP-like address, or nil.
+func AddrIP(addr net.Addr) net.IP {
+	return net.ParseIP(IPString(addr).String())
+}
+
+type IPNets []*net.IPNet
+
+// ParseIPNets accepts CIDR networks and bare addresses, which are treated as
+// single-host networks.
+func ParseIPNets(strs []string) (nets IPNets, err error) {
+	nets = make(IPNets, 0, len(strs))
+	for _, str := range strs {
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", str)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+
+func (nets IPNets) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -13,21 +13,17 @@ func (m *NickCommand) HandleRegServer(s *Server) {
 		return
 	}
 
-	if client.capState == CapNegotiating {
-		client.capState = CapNegotiated
-	}
-
 	if m.nickname == "" {
 		client.ErrNoNicknameGiven()
 		return
 	}
 
-	if s.clients.Get(m.nickname) != nil {
+	if s.nickInUse(m.nickname, client) {
 		client.ErrNickNameInUse(m.nickname)
 		return
 	}
 
-	if !m.nickname.IsNickname() {
+	if !s.limits.IsNickname(m.nickname) {
 		client.ErrErroneusNickname(m.nickname)
 		return
 	}
@@ -44,7 +40,7 @@ func (msg *NickCommand) HandleServer(server *Server) {
 		return
 	}
 
-	if !msg.nickname.IsNickname() {
+	if !server.limits.IsNickname(msg.nickname) {
 		client.ErrErroneusNickname(msg.nickname)
 		return
 	}
@@ -53,13 +49,13 @@ func (msg *NickCommand) HandleServer(server *Server) {
 		return
 	}
 
-	target := server.clients.Get(msg.nickname)
-	if (target != nil) && (target != client) {
+	if server.nickInUse(msg.nickname, client) {
 		client.ErrNickNameInUse(msg.nickname)
 		return
 	}
 
 	client.ChangeNickname(msg.nickname)
+	server.checkNickProtection(client)
 }
 
 type OperNickCommand struct {
@@ -71,12 +67,12 @@ type OperNickCommand struct {
 func (msg *OperNickCommand) HandleServer(server *Server) {
 	client := msg.Client()
 
-	if !client.flags[Operator] {
+	if !client.HasPrivilege(PrivRename) {
 		client.ErrNoPrivileges()
 		return
 	}
 
-	if !msg.nick.IsNickname() {
+	if !server.limits.IsNickname(msg.nick) {
 		client.ErrErroneusNickname(msg.nick)
 		return
 	}
@@ -91,10 +87,25 @@ func (msg *OperNickCommand) HandleServer(server *Server) {
 		return
 	}
 
-	if server.clients.Get(msg.nick) != nil {
+	if server.nickInUse(msg.nick, target) {
 		client.ErrNickNameInUse(msg.nick)
 		return
 	}
 
 	target.ChangeNickname(msg.nick)
+	server.checkNickProtection(target)
+}
+
+// nickInUse is true when nick, or a nick that looks like it, belongs to a
+// service or to a client other than owner.
+func (server *Server) nickInUse(nick Name, owner *Client) bool {
+	if (server.services.Get(nick) != nil) || (server.services.Confusable(nick) != nil) {
+		return true
+	}
+	for _, client := range []*Client{server.clients.Get(nick), server.clients.Confusable(nick)} {
+		if (client != nil) && (client != owner) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,362 @@
+package irc
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	NICK_GRACE_PERIOD = time.Minute // how long to IDENTIFY before a rename
+)
+
+var (
+	nickServHelp = []string{
+		"NickServ registers nicknames as accounts.",
+		"REGISTER <password> [CERT]          register your current nick",
+		"IDENTIFY [<account>] <password>     log in to an account",
+		"GHOST <nick> [<password>]           disconnect a user of your nick",
+		"SETPASS <password>                  change your account password",
+		"DROP <password>                     delete your account",
+		"REGISTER with CERT also stores your TLS client certificate, which then",
+		"logs you in with SASL EXTERNAL.",
+		"Registered nicks used by anyone else are renamed after " +
+			NICK_GRACE_PERIOD.String() + ".",
+	}
+)
+
+func NewNickServ(server *Server) *Service {
+	return NewService(server, "NickServ", map[string]ServiceCommandFunc{
+		"DROP":     nickServDrop,
+		"GHOST":    nickServGhost,
+		"IDENTIFY": nickServIdentify,
+		"REGISTER": nickServRegister,
+		"SETPASS":  nickServSetPass,
+	}, nickServHelp)
+}
+
+// getAccount reports lookup failures to the client.
+func (service *Service) getAccount(client *Client, name Name) *Account {
+	account, err := service.server.accounts.Get(name)
+	if err == ErrNoSuchAccount {
+		service.Notice(client, "%s is not registered.", name)
+		return nil
+	} else if err != nil {
+		Log.error.Printf("%s: %s", service, err)
+		service.Notice(client, "Internal error.")
+		return nil
+	}
+	return account
+}
+
+func nickServRegister(service *Service, client *Client, args []string) {
+	withCert := (len(args) == 2) && (strings.ToUpper(args[1]) == "CERT")
+	if (len(args) < 1) || ((len(args) > 1) && !withCert) {
+		service.Notice(client, "Usage: REGISTER <password> [CERT]")
+		return
+	}
+	if client.account != "" {
+		service.Notice(client, "You are already logged in as %s.", client.account)
+		return
+	}
+
+	account := &Account{
+		created: time.Now(),
+		name:    client.nick,
+	}
+	if _, err := service.server.accounts.Get(account.name); err != ErrNoSuchAccount {
+		service.Notice(client, "%s is already registered.", account.name)
+		return
+	}
+
+	// The certificate is only attached on request, since it lets SASL
+	// EXTERNAL log in without the password.
+	if withCert {
+		if client.certfp == "" {
+			service.Notice(client, "You have no TLS client certificate.")
+			return
+		}
+		_, err := service.server.accounts.GetByCertFP(client.certfp)
+		if err == nil {
+			service.Notice(client, "Your certificate is registered to another account.")
+			return
+		} else if err != ErrNoSuchAccount {
+			Log.error.Printf("%s: %s", service, err)
+			service.Notice(client, "Internal error.")
+			return
+		}
+		account.certfp = client.certfp
+	}
+
+	client.Bcrypt(func() (err error) {
+		account.hash, err = GeneratePassword(args[0])
+		return
+	}, func(err error) {
+		if err == nil {
+			err = service.server.accounts.Add(account)
+		}
+		switch err {
+		case nil:
+			if account.certfp != "" {
+				service.Notice(client, "%s is now registered to you and your certificate.",
+					account.name)
+			} else {
+				service.Notice(client, "%s is now registered to you.", account.name)
+			}
+			service.server.accountLogin(client, account.name)
+
+		case ErrAccountExists:
+			service.Notice(client, "%s is already registered.", account.name)
+
+		case ErrCertFPExists:
+			service.Notice(client, "Your certificate is registered to another account.")
+
+		default:
+			Log.error.Printf("%s: %s", service, err)
+			service.Notice(client, "Registration failed.")
+		}
+	})
+}
+
+func nickServIdentify(service *Service, client *Client, args []string) {
+	name := client.nick
+	switch len(args) {
+	case 0:
+		service.Notice(client, "Usage: IDENTIFY [<account>] <password>")
+		return
+
+	case 1:
+		args = []string{name.String(), args[0]}
+
+	default:
+		name = NewName(args[0])
+	}
+
+	if client.account != "" {
+		service.Notice(client, "You are already logged in as %s.", client.account)
+		return
+	}
+
+	account := service.getAccount(client, name)
+	if account == nil {
+		return
+	}
+
+	client.Bcrypt(func() error {
+		return account.CheckPassword([]byte(args[1]))
+	}, func(err error) {
+		if err != nil {
+			service.Notice(client, "Invalid password for %s.", account.name)
+			return
+		}
+		if client.account == "" {
+			service.Notice(client, "You are now identified for %s.", account.name)
+			service.server.accountLogin(client, account.name)
+		}
+	})
+}
+
+func nickServGhost(service *Service, client *Client, args []string) {
+	if len(args) < 1 {
+		service.Notice(client, "Usage: GHOST <nick> [<password>]")
+		return
+	}
+
+	nick := NewName(args[0])
+	target := service.server.clients.Get(nick)
+	if target == nil {
+		service.Notice(client, "%s is not online.", nick)
+		return
+	}
+	if target == client {
+		service.Notice(client, "You can't ghost yourself.")
+		return
+	}
+
+	account := service.getAccount(client, nick)
+	if account == nil {
+		return
+	}
+
+	ghost := func(err error) {
+		if err != nil {
+			service.Notice(client, "Invalid password for %s.", account.name)
+			return
+		}
+		if target.hasQuit {
+			return
+		}
+		target.Quit(NewText(fmt.Sprintf("GHOST command used by %s", client.nick)))
+		service.Notice(client, "%s has been ghosted.", nick)
+	}
+
+	if client.account.ToLower() == account.name.ToLower() {
+		ghost(nil)
+		return
+	}
+	if len(args) < 2 {
+		service.Notice(client, "You are not identified for %s.", account.name)
+		return
+	}
+	client.Bcrypt(func() error {
+		return account.CheckPassword([]byte(args[1]))
+	}, ghost)
+}
+
+func nickServSetPass(service *Service, client *Client, args []string) {
+	if len(args) < 1 {
+		service.Notice(client, "Usage: SETPASS <password>")
+		return
+	}
+	if client.account == "" {
+		service.Notice(client, "You are not logged in.")
+		return
+	}
+
+	name := client.account
+	var hash []byte
+	client.Bcrypt(func() (err error) {
+		hash, err = GeneratePassword(args[0])
+		return
+	}, func(err error) {
+		if err == nil {
+			err = service.server.accounts.SetPassword(name, hash)
+		}
+		if err != nil {
+			Log.error.Printf("%s: %s", service, err)
+			service.Notice(client, "Password change failed.")
+			return
+		}
+		service.Notice(client, "Password changed for %s.", name)
+	})
+}
+
+func nickServDrop(service *Service, client *Client, args []string) {
+	if len(args) < 1 {
+		service.Notice(client, "Usage: DROP <password>")
+		return
+	}
+	if client.account == "" {
+		service.Notice(client, "You are not logged in.")
+		return
+	}
+
+	account := service.getAccount(client, client.account)
+	if account == nil {
+		return
+	}
+
+	client.Bcrypt(func() error {
+		return account.CheckPassword([]byte(args[0]))
+	}, func(err error) {
+		if err != nil {
+			service.Notice(client, "Invalid password for %s.", account.name)
+			return
+		}
+		err = service.server.accounts.Remove(account.name)
+		if err == nil {
+			err = service.server.registry.RemoveAccount(account.name)
+		}
+		if err != nil {
+			Log.error.Printf("%s: %s", service, err)
+			service.Notice(client, "Drop failed.")
+			return
+		}
+
+		service.Notice(client, "%s has been dropped.", account.name)
+		for _, member := range service.server.clients.byNick {
+			if member.account.ToLower() == account.name.ToLower() {
+				service.server.accountLogout(member)
+			}
+		}
+	})
+}
+
+//
+// logins
+//
+
+func (server *Server) accountLogin(client *Client, name Name) {
+	client.account = name
+	client.RplLoggedIn()
+	client.notifyAccount()
+	server.checkNickProtection(client)
+	for channel := range client.channels {
+		channel.applyAccess(client)
+	}
+}
+
+func (server *Server) accountLogout(client *Client) {
+	client.account = ""
+	client.RplLoggedOut()
+	client.notifyAccount()
+	server.checkNickProtection(client)
+}
+
+// notifyAccount tells account-notify clients in shared channels.
+func (client *Client) notifyAccount() {
+	reply := RplAccount(client)
+	for friend := range client.Friends() {
+		if (friend != client) && friend.capabilities[AccountNotify] {
+			friend.Reply(reply)
+		}
+	}
+}
+
+//
+// nick protection
+//
+
+// checkNickProtection gives a registered client using someone else's
+// registered nick the grace period to identify. It is called whenever the
+// nick or the login changes.
+func (server *Server) checkNickProtection(client *Client) {
+	if client.nickTimer != nil {
+		client.nickTimer.Stop()
+		client.nickTimer = nil
+	}
+	if !client.registered || !server.isProtectedNick(client, client.nick) {
+		return
+	}
+
+	nick := client.nick
+	server.nickServ.Notice(client,
+		"%s is registered. IDENTIFY within %s or your nick will be changed.",
+		nick, NICK_GRACE_PERIOD)
+	client.nickTimer = time.AfterFunc(NICK_GRACE_PERIOD, func() {
+		client.send(NewNickProtectCommand(nick))
+	})
+}
+
+func (server *Server) isProtectedNick(client *Client, nick Name) bool {
+	account, err := server.accounts.Get(nick)
+	if err != nil {
+		if err != ErrNoSuchAccount {
+			Log.error.Println("Server.isProtectedNick:", err)
+		}
+		return false
+	}
+	return client.account.ToLower() != account.name.ToLower()
+}
+
+func (server *Server) guestNick() Name {
+	for {
+		nick := Name(fmt.Sprintf("Guest%05d", rand.Intn(100000)))
+		if server.clients.Get(nick) == nil {
+			return nick
+		}
+	}
+}
+
+func (msg *NickProtectCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if client.hasQuit || (client.nick != msg.nick) ||
+		!server.isProtectedNick(client, client.nick) {
+		return
+	}
+
+	client.nickTimer = nil
+	server.nickServ.Notice(client, "You did not identify for %s in time.", client.nick)
+	client.ChangeNickname(server.guestNick())
+}
@@ -0,0 +1,79 @@
+package irc
+
+import (
+	"errors"
+)
+
+// OperPrivilege is something an operator class allows. The Operator flag
+// alone only marks a client as an oper.
+type OperPrivilege string
+
+const (
+	PrivBan        OperPrivilege = "ban"         // KLINE, DLINE and STATS k/d
+	PrivDebug      OperPrivilege = "debug"       // DEBUG
+	PrivDie        OperPrivilege = "die"         // DIE and RESTART
+	PrivKill       OperPrivilege = "kill"        // KILL
+	PrivRehash     OperPrivilege = "rehash"      // REHASH
+	PrivRename     OperPrivilege = "rename"      // ONICK
+	PrivSAMode     OperPrivilege = "samode"      // act as a channel operator; other users' modes
+	PrivSeePrivate OperPrivilege = "see-private" // private channels, channel keys, certfps
+)
+
+var (
+	ErrNoSuchPrivilege = errors.New("no such privilege")
+
+	OperPrivileges = []OperPrivilege{
+		PrivBan, PrivDebug, PrivDie, PrivKill, PrivRehash, PrivRename, PrivSAMode,
+		PrivSeePrivate}
+)
+
+// OperClass is the set of privileges granted by an `operclass` section.
+type OperClass map[OperPrivilege]bool
+
+func NewOperClass(privileges []string) (OperClass, error) {
+	class := make(OperClass)
+	for _, str := range privileges {
+		privilege := OperPrivilege(str)
+		if !AllPrivileges()[privilege] {
+			return nil, ErrNoSuchPrivilege
+		}
+		class[privilege] = true
+	}
+	return class, nil
+}
+
+// AllPrivileges is the class of an operator configured without one.
+func AllPrivileges() OperClass {
+	class := make(OperClass)
+	for _, privilege := range OperPrivileges {
+		class[privilege] = true
+	}
+	return class
+}
+
+func (client *Client) HasPrivilege(privilege OperPrivilege) bool {
+	return client.flags[Operator] && client.operClass[privilege]
+}
+
+// checkOper gives an operator the privileges its operator block has now, or
+// takes operator status away if the block is gone or no longer matches the
+// client's host.
+func (server *Server) checkOper(client *Client) {
+	if !client.flags[Operator] {
+		return
+	}
+	operator := server.operators[client.operName]
+	if (operator != nil) &&
+		((operator.hostmasks == nil) || operator.hostmasks.Match(client)) {
+		client.operClass = operator.class
+		return
+	}
+
+	delete(client.flags, Operator)
+	client.operClass = nil
+	client.fakelag.SetOper(false)
+	client.Reply(RplModeChanges(client, client, ModeChanges{&ModeChange{
+		mode: Operator,
+		op:   Remove,
+	}}))
+}
@@ -10,19 +10,27 @@ var (
 	EmptyPasswordError = errors.New("empty password")
 )
 
-func GenerateEncodedPassword(passwd string) (encoded string, err error) {
+func GeneratePassword(passwd string) (bcrypted []byte, err error) {
 	if passwd == "" {
 		err = EmptyPasswordError
 		return
 	}
-	bcrypted, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.MinCost)
+	return bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.MinCost)
+}
+
+func GenerateEncodedPassword(passwd string) (encoded string, err error) {
+	bcrypted, err := GeneratePassword(passwd)
 	if err != nil {
 		return
 	}
-	encoded = base64.StdEncoding.EncodeToString(bcrypted)
+	encoded = EncodePassword(bcrypted)
 	return
 }
 
+func EncodePassword(bcrypted []byte) string {
+	return base64.StdEncoding.EncodeToString(bcrypted)
+}
+
 func DecodePassword(encoded string) (decoded []byte, err error) {
 	if encoded == "" {
 		err = EmptyPasswordError
@@ -35,3 +43,14 @@ func DecodePassword(encoded string) (decoded []byte, err error) {
 func ComparePassword(hash, password []byte) error {
 	return bcrypt.CompareHashAndPassword(hash, password)
 }
+
+func (msg *BcryptCommand) HandleRegServer(server *Server) {
+	if msg.Client().hasQuit {
+		return
+	}
+	msg.done(msg.err)
+}
+
+func (msg *BcryptCommand) HandleServer(server *Server) {
+	msg.HandleRegServer(server)
+}
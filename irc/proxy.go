@@ -0,0 +1,187 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PROXY_HEADER_TIMEOUT = 10 * time.Second
+	PROXY_V1_MAX_LEN     = 107 // including CRLF
+)
+
+var (
+	ErrProxyHeader        = errors.New("invalid PROXY header")
+	ErrProxyHeaderMissing = errors.New("missing PROXY header")
+	proxyV2Signature      = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyListener accepts connections for a listener marked as proxied. Only
+// trusted networks may connect, and every connection must start with a PROXY
+// protocol header.
+type ProxyListener struct {
+	net.Listener
+	proxies IPNets
+}
+
+func (listener *ProxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if listener.proxies.Contains(AddrIP(conn.RemoteAddr())) {
+			return NewProxyConn(conn), nil
+		}
+		Log.warn.Printf("untrusted proxy connection: %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// ProxyConn reads the PROXY header before any other data, whether the first
+// read comes from the Socket, a TLS handshake, or an HTTP server.
+type ProxyConn struct {
+	net.Conn
+	err        error
+	mutex      sync.Mutex
+	once       sync.Once
+	remoteAddr net.Addr
+}
+
+func NewProxyConn(conn net.Conn) *ProxyConn {
+	return &ProxyConn{
+		Conn: conn,
+	}
+}
+
+func (conn *ProxyConn) RemoteAddr() net.Addr {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+func (conn *ProxyConn) Read(b []byte) (int, error) {
+	if err := conn.ReadHeader(); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *ProxyConn) ReadHeader() error {
+	conn.once.Do(func() {
+		conn.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+		addr, err := readProxyHeader(conn.Conn)
+		conn.Conn.SetReadDeadline(time.Time{})
+
+		conn.mutex.Lock()
+		conn.remoteAddr, conn.err = addr, err
+		conn.mutex.Unlock()
+	})
+	return conn.err
+}
+
+// readProxyHeader consumes exactly one v1 or v2 header and nothing past it.
+// A nil address means the proxy sent no address (LOCAL or UNKNOWN).
+func readProxyHeader(reader io.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(header, proxyV2Signature) {
+		return readProxyV2(reader)
+	}
+
+	if !bytes.HasPrefix(header, []byte(PROXY.String()+" ")) {
+		return nil, ErrProxyHeaderMissing
+	}
+
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte(CRLF)) {
+		if len(header) >= PROXY_V1_MAX_LEN {
+			return nil, ErrProxyHeader
+		}
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+	return parseProxyV1(strings.TrimSuffix(string(header), CRLF))
+}
+
+// PROXY ( TCP4 / TCP6 ) <source> <dest> <source port> <dest port>
+// PROXY UNKNOWN ...
+func parseProxyV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 {
+		return nil, ErrProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, ErrProxyHeader
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if (ip == nil) || (err != nil) {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+	return nil, ErrProxyHeader
+}
+
+// The signature is followed by version/command, family/protocol, and the
+// big-endian length of the address block.
+func readProxyV2(reader io.Reader) (net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if (header[0] >> 4) != 2 {
+		return nil, ErrProxyHeader
+	}
+
+	block := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are health checks from the proxy itself.
+	if (header[0] & 0x0f) == 0 {
+		return nil, nil
+	}
+	if (header[0] & 0x0f) != 1 {
+		return nil, ErrProxyHeader
+	}
+
+	var ipLen int
+	switch header[1] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil
+	}
+
+	if len(block) < (2*ipLen + 4) {
+		return nil, ErrProxyHeader
+	}
+	ip := net.IP(block[:ipLen])
+	port := binary.BigEndian.Uint16(block[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
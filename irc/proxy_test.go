@@ -0,0 +1,115 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header: signature, version/command, family/protocol,
+// and the address block.
+func proxyV2(command byte, family byte, block []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(block)))
+	return append(header, block...)
+}
+
+func proxyV2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	block := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+	return append(block, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string // empty for no address
+		err    error
+	}{
+		{"v1 tcp4",
+			[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 5678 6667\r\n"),
+			"192.0.2.1:5678", nil},
+		{"v1 tcp6",
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 5678 6667\r\n"),
+			"[2001:db8::1]:5678", nil},
+		{"v1 unknown",
+			[]byte("PROXY UNKNOWN\r\n"), "", nil},
+		{"v1 unknown with addresses",
+			[]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", nil},
+		{"v1 bad address",
+			[]byte("PROXY TCP4 192.0.2.x 198.51.100.1 5678 6667\r\n"),
+			"", ErrProxyHeader},
+		{"v1 bad port",
+			[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 6667\r\n"),
+			"", ErrProxyHeader},
+		{"v1 missing fields",
+			[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 5678\r\n"),
+			"", ErrProxyHeader},
+		{"v1 bad protocol",
+			[]byte("PROXY UDP4 192.0.2.1 198.51.100.1 5678 6667\r\n"),
+			"", ErrProxyHeader},
+		{"v1 too long",
+			[]byte("PROXY UNKNOWN " + strings.Repeat("x", PROXY_V1_MAX_LEN) + "\r\n"),
+			"", ErrProxyHeader},
+		{"missing",
+			[]byte("NICK alice\r\nUSER a 0 * :a\r\n"), "", ErrProxyHeaderMissing},
+		{"v2 tcp4",
+			proxyV2(1, 1, proxyV2Addrs(net.IPv4(192, 0, 2, 1).To4(),
+				net.IPv4(198, 51, 100, 1).To4(), 5678, 6667)),
+			"192.0.2.1:5678", nil},
+		{"v2 tcp6",
+			proxyV2(1, 2, proxyV2Addrs(net.ParseIP("2001:db8::1"),
+				net.ParseIP("2001:db8::2"), 5678, 6667)),
+			"[2001:db8::1]:5678", nil},
+		{"v2 tcp4 with TLVs",
+			proxyV2(1, 1, append(proxyV2Addrs(net.IPv4(192, 0, 2, 1).To4(),
+				net.IPv4(198, 51, 100, 1).To4(), 5678, 6667), 0x04, 0, 1, 0)),
+			"192.0.2.1:5678", nil},
+		{"v2 local",
+			proxyV2(0, 0, nil), "", nil},
+		{"v2 unspec",
+			proxyV2(1, 0, nil), "", nil},
+		{"v2 short block",
+			proxyV2(1, 1, []byte{192, 0, 2, 1}), "", ErrProxyHeader},
+		{"v2 bad command",
+			proxyV2(2, 1, proxyV2Addrs(net.IPv4(192, 0, 2, 1).To4(),
+				net.IPv4(198, 51, 100, 1).To4(), 5678, 6667)),
+			"", ErrProxyHeader},
+		{"v2 truncated",
+			proxyV2(1, 1, nil)[:len(proxyV2Signature)+2], "", io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The header must be consumed exactly, leaving the IRC traffic.
+			const rest = "NICK alice\r\n"
+			reader := bytes.NewReader(append(append([]byte{}, test.header...), rest...))
+			addr, err := readProxyHeader(reader)
+			if err != test.err {
+				t.Fatalf("err = %v, expected %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if (addr == nil) != (test.addr == "") {
+				t.Fatalf("addr = %v, expected %q", addr, test.addr)
+			}
+			if (addr != nil) && (addr.String() != test.addr) {
+				t.Errorf("addr = %s, expected %s", addr, test.addr)
+			}
+
+			remaining, _ := io.ReadAll(reader)
+			if string(remaining) != rest {
+				t.Errorf("left %q, expected %q", remaining, rest)
+			}
+		})
+	}
+}
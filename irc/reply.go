@@ -24,12 +24,31 @@ func (code NumericCode) String() string {
 
 func NewStringReply(source Identifiable, code StringCode,
 	format string, args ...interface{}) string {
+	return NewTaggedReply(nil, source, code, format, args...)
+}
+
+// Tags are serialized for every recipient; Client.Reply strips the ones a
+// client has not negotiated. Messages from a logged-in client also carry its
+// account. The caller's tags are not modified.
+func NewTaggedReply(tags Tags, source Identifiable, code StringCode,
+	format string, args ...interface{}) string {
+	if client, ok := source.(*Client); ok && (client.account != "") {
+		accountTags := make(Tags, len(tags)+1)
+		for key, value := range tags {
+			accountTags[key] = value
+		}
+		accountTags["account"] = client.account.String()
+		tags = accountTags
+	}
 	var header string
 	if source == nil {
 		header = code.String() + " "
 	} else {
 		header = fmt.Sprintf(":%s %s ", source, code)
 	}
+	if len(tags) > 0 {
+		header = "@" + tags.String() + " " + header
+	}
 	var message string
 	if len(args) > 0 {
 		message = fmt.Sprintf(format, args...)
@@ -96,7 +115,12 @@ func (target *Client) MultilineReply(names []string, code NumericCode, format st
 //
 
 func RplPrivMsg(source Identifiable, target Identifiable, message Text) string {
-	return NewStringReply(source, PRIVMSG, "%s :%s", target.Nick(), message)
+	return RplTaggedPrivMsg(nil, source, target, message)
+}
+
+func RplTaggedPrivMsg(tags Tags, source Identifiable, target Identifiable,
+	message Text) string {
+	return NewTaggedReply(tags, source, PRIVMSG, "%s :%s", target.Nick(), message)
 }
 
 func RplCTCPAction(source Identifiable, target Identifiable, action CTCPText) string {
@@ -104,23 +128,50 @@ func RplCTCPAction(source Identifiable, target Identifiable, action CTCPText) st
 }
 
 func RplNotice(source Identifiable, target Identifiable, message Text) string {
-	return NewStringReply(source, NOTICE, "%s :%s", target.Nick(), message)
+	return RplTaggedNotice(nil, source, target, message)
+}
+
+func RplTaggedNotice(tags Tags, source Identifiable, target Identifiable,
+	message Text) string {
+	return NewTaggedReply(tags, source, NOTICE, "%s :%s", target.Nick(), message)
+}
+
+func RplTagMsg(tags Tags, source Identifiable, target Identifiable) string {
+	return NewTaggedReply(tags, source, TAGMSG, target.Nick().String())
 }
 
 func RplNick(source Identifiable, newNick Name) string {
 	return NewStringReply(source, NICK, newNick.String())
 }
 
-func RplJoin(client *Client, channel *Channel) string {
-	return NewStringReply(client, JOIN, channel.name.String())
+// RplJoin adds the account and realname for extended-join recipients.
+func RplJoin(tags Tags, client *Client, channel *Channel, extended bool) string {
+	if !extended {
+		return NewTaggedReply(tags, client, JOIN, channel.name.String())
+	}
+	account := client.account
+	if account == "" {
+		account = "*"
+	}
+	return NewTaggedReply(tags, client, JOIN, "%s %s :%s", channel, account,
+		client.realname)
+}
+
+func RplAccount(client *Client) string {
+	account := client.account
+	if account == "" {
+		account = "*"
+	}
+	return NewTaggedReply(NewMessageTags(nil), client, ACCOUNT, account.String())
 }
 
 func RplPart(client *Client, channel *Channel, message Text) string {
-	return NewStringReply(client, PART, "%s :%s", channel, message)
+	return NewTaggedReply(NewMessageTags(nil), client, PART, "%s :%s", channel, message)
 }
 
 func RplModeChanges(client *Client, target *Client, changes ModeChanges) string {
-	return NewStringReply(client, MODE, "%s :%s", target.Nick(), changes)
+	return NewTaggedReply(NewMessageTags(nil), client, MODE, "%s :%s",
+		target.Nick(), changes)
 }
 
 func RplCurrentMode(client *Client, target *Client) string {
@@ -138,13 +189,14 @@ func RplCurrentMode(client *Client, target *Client) string {
 	return RplNotice(client.server, client, response)
 }
 
-func RplChannelMode(client *Client, channel *Channel,
+func RplChannelMode(source Identifiable, channel *Channel,
 	changes ChannelModeChanges) string {
-	return NewStringReply(client, MODE, "%s %s", channel, changes)
+	return NewTaggedReply(NewMessageTags(nil), source, MODE, "%s %s", channel, changes)
 }
 
 func RplTopicMsg(source Identifiable, channel *Channel) string {
-	return NewStringReply(source, TOPIC, "%s :%s", channel, channel.topic)
+	return NewTaggedReply(NewMessageTags(nil), source, TOPIC, "%s :%s",
+		channel, channel.topic)
 }
 
 func RplPing(target Identifiable) string {
@@ -156,7 +208,7 @@ func RplPong(client *Client, msg Text) string {
 }
 
 func RplQuit(client *Client, message Text) string {
-	return NewStringReply(client, QUIT, ":%s", message)
+	return NewTaggedReply(NewMessageTags(nil), client, QUIT, ":%s", message)
 }
 
 func RplError(message string) string {
@@ -168,7 +220,7 @@ func RplInviteMsg(inviter *Client, invitee *Client, channel Name) string {
 }
 
 func RplKick(channel *Channel, client *Client, target *Client, comment Text) string {
-	return NewStringReply(client, KICK, "%s %s :%s",
+	return NewTaggedReply(NewMessageTags(nil), client, KICK, "%s %s :%s",
 		channel, target.Nick(), comment)
 }
 
@@ -181,6 +233,15 @@ func RplCap(client *Client, subCommand CapSubCommand, arg interface{}) string {
 	return NewStringReply(nil, CAP, "%s %s :%s", client.Nick(), subCommand, arg)
 }
 
+func RplAuthenticate(arg string) string {
+	return NewStringReply(nil, AUTHENTICATE, arg)
+}
+
+// RplCapMore is a CAP 302 reply that continues on the next line.
+func RplCapMore(client *Client, subCommand CapSubCommand, arg interface{}) string {
+	return NewStringReply(nil, CAP, "%s %s * :%s", client.Nick(), subCommand, arg)
+}
+
 // numeric replies
 
 func (target *Client) RplWelcome() {
@@ -236,11 +297,27 @@ func (target *Client) RplYoureOper() {
 		":You are now an IRC operator")
 }
 
+func (target *Client) RplRehashing(configFile string) {
+	target.NumericReply(RPL_REHASHING,
+		"%s :Rehashing", configFile)
+}
+
+func (target *Client) RplHostHidden() {
+	target.NumericReply(RPL_HOSTHIDDEN,
+		"%s :is now your displayed host", target.hostname)
+}
+
 func (target *Client) RplWhois(client *Client) {
 	target.RplWhoisUser(client)
 	if client.flags[Operator] {
 		target.RplWhoisOperator(client)
 	}
+	if client.account != "" {
+		target.RplWhoisAccount(client)
+	}
+	if (client.certfp != "") && ((target == client) || target.HasPrivilege(PrivSeePrivate)) {
+		target.RplWhoisCertFP(client)
+	}
 	target.RplWhoisIdle(client)
 	target.RplWhoisChannels(client)
 	target.RplEndOfWhois()
@@ -257,6 +334,16 @@ func (target *Client) RplWhoisOperator(client *Client) {
 		"%s :is an IRC operator", client.Nick())
 }
 
+func (target *Client) RplWhoisAccount(client *Client) {
+	target.NumericReply(RPL_WHOISACCOUNT,
+		"%s %s :is logged in as", client.Nick(), client.account)
+}
+
+func (target *Client) RplWhoisCertFP(client *Client) {
+	target.NumericReply(RPL_WHOISCERTFP,
+		"%s :has client certificate fingerprint %s", client.Nick(), client.certfp)
+}
+
 func (target *Client) RplWhoisIdle(client *Client) {
 	target.NumericReply(RPL_WHOISIDLE,
 		"%s %d %d :seconds idle, signon time",
@@ -442,6 +529,21 @@ func (target *Client) RplTime() {
 		"%s :%s", target.server.name, time.Now().Format(time.RFC1123))
 }
 
+func (target *Client) RplStatsBan(ban *Ban) {
+	code := RPL_STATSKLINE
+	if ban.kind == DLine {
+		code = RPL_STATSDLINE
+	}
+	target.NumericReply(code,
+		"%s %s %s %s :%s", ban.kind, ban.mask, ban.oper, ban.ExpiresString(),
+		ban.reason)
+}
+
+func (target *Client) RplEndOfStats(query string) {
+	target.NumericReply(RPL_ENDOFSTATS,
+		"%s :End of STATS report", query)
+}
+
 func (target *Client) RplWhoWasUser(whoWas *WhoWas) {
 	target.NumericReply(RPL_WHOWASUSER,
 		"%s %s %s * :%s",
@@ -462,6 +564,46 @@ func (target *Client) ErrAlreadyRegistered() {
 		":You may not reregister")
 }
 
+func (target *Client) RplLoggedIn() {
+	target.NumericReply(RPL_LOGGEDIN,
+		"%s %s :You are now logged in as %s", target.UserHost(), target.account,
+		target.account)
+}
+
+func (target *Client) RplLoggedOut() {
+	target.NumericReply(RPL_LOGGEDOUT,
+		"%s :You are now logged out", target.UserHost())
+}
+
+func (target *Client) RplSASLSuccess() {
+	target.NumericReply(RPL_SASLSUCCESS, ":SASL authentication successful")
+}
+
+func (target *Client) ErrSASLFail() {
+	target.NumericReply(ERR_SASLFAIL, ":SASL authentication failed")
+}
+
+func (target *Client) ErrSASLTooLong() {
+	target.NumericReply(ERR_SASLTOOLONG, ":SASL message too long")
+}
+
+func (target *Client) ErrSASLAborted() {
+	target.NumericReply(ERR_SASLABORTED, ":SASL authentication aborted")
+}
+
+func (target *Client) ErrSASLAlready() {
+	target.NumericReply(ERR_SASLALREADY, ":You have already authenticated using SASL")
+}
+
+func (target *Client) RplSASLMechs() {
+	target.NumericReply(RPL_SASLMECHS,
+		"%s :are available SASL mechanisms", target.server.capValues[SASL])
+}
+
+func (target *Client) ErrInputTooLong() {
+	target.NumericReply(ERR_INPUTTOOLONG, ":Input line was too long")
+}
+
 func (target *Client) ErrNickNameInUse(nick Name) {
 	target.NumericReply(ERR_NICKNAMEINUSE,
 		"%s :Nickname is already in use", nick)
@@ -482,6 +624,11 @@ func (target *Client) ErrNeedMoreParams(command StringCode) {
 		"%s :Not enough parameters", command)
 }
 
+func (target *Client) ErrUnavailResource(name Name) {
+	target.NumericReply(ERR_UNAVAILRESOURCE,
+		"%s :Nick/channel is temporarily unavailable", name)
+}
+
 func (target *Client) ErrNoSuchChannel(channel Name) {
 	target.NumericReply(ERR_NOSUCHCHANNEL,
 		"%s :No such channel", channel)
@@ -525,6 +672,10 @@ func (target *Client) ErrNoPrivileges() {
 	target.NumericReply(ERR_NOPRIVILEGES, ":Permission Denied")
 }
 
+func (target *Client) ErrNoOperHost() {
+	target.NumericReply(ERR_NOOPERHOST, ":No O-lines for your host")
+}
+
 func (target *Client) ErrRestricted() {
 	target.NumericReply(ERR_RESTRICTED, ":Your connection is restricted!")
 }
@@ -562,6 +713,21 @@ func (target *Client) ErrErroneusNickname(nick Name) {
 		"%s :Erroneous nickname", nick)
 }
 
+func (target *Client) ErrTooManyChannels(channel Name) {
+	target.NumericReply(ERR_TOOMANYCHANNELS,
+		"%s :You have joined too many channels", channel)
+}
+
+func (target *Client) ErrBanListFull(channel *Channel, mode ChannelMode) {
+	target.NumericReply(ERR_BANLISTFULL,
+		"%s %s :Channel list is full", channel, mode)
+}
+
+func (target *Client) ErrBadMask(mask Name) {
+	target.NumericReply(ERR_BADMASK,
+		"%s :Bad Server/host mask", mask)
+}
+
 func (target *Client) ErrUnknownMode(mode ChannelMode, channel *Channel) {
 	target.NumericReply(ERR_UNKNOWNMODE,
 		"%s :is unknown mode char to me for %s", mode, channel)
@@ -592,6 +758,11 @@ func (target *Client) ErrBannedFromChan(channel *Channel) {
 		"%s :Cannot join channel (+b)", channel)
 }
 
+func (target *Client) ErrYoureBannedCreep(ban *Ban) {
+	target.NumericReply(ERR_YOUREBANNEDCREEP,
+		":You are banned from this server (%s)", ban.reason)
+}
+
 func (target *Client) ErrInviteOnlyChan(channel *Channel) {
 	target.NumericReply(ERR_INVITEONLYCHAN,
 		"%s :Cannot join channel (+i)", channel)
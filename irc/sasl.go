@@ -0,0 +1,209 @@
+package irc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	SASL_CHUNK_LEN = 400      // longest AUTHENTICATE argument
+	SASL_MAX_LEN   = 4 * 1024 // longest encoded response
+)
+
+type SASLMechanism string
+
+const (
+	SASLExternal SASLMechanism = "EXTERNAL"
+	SASLPlain    SASLMechanism = "PLAIN"
+)
+
+var (
+	ErrSASLTooLong          = errors.New("SASL message too long")
+	SupportedSASLMechanisms = []SASLMechanism{SASLExternal, SASLPlain}
+)
+
+// SASLMechanisms is the comma-separated list used in the CAP value and 908.
+func SASLMechanisms(mechanisms []SASLMechanism) string {
+	strs := make([]string, len(mechanisms))
+	for index, mechanism := range mechanisms {
+		strs[index] = string(mechanism)
+	}
+	return strings.Join(strs, ",")
+}
+
+// SASLState is an exchange in progress. Registration waits while a client
+// has one.
+type SASLState struct {
+	buffer    string
+	mechanism SASLMechanism
+	pending   bool // a password is being checked off the server goroutine
+}
+
+// Add buffers an AUTHENTICATE argument and reports whether the response is
+// complete. "+" is an empty chunk; a full-length chunk means more are coming.
+func (state *SASLState) Add(chunk string) (done bool, err error) {
+	if (len(chunk) > SASL_CHUNK_LEN) ||
+		((len(state.buffer) + len(chunk)) > SASL_MAX_LEN) {
+		return false, ErrSASLTooLong
+	}
+	if chunk != "+" {
+		state.buffer += chunk
+	}
+	return len(chunk) < SASL_CHUNK_LEN, nil
+}
+
+func (state *SASLState) Response() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(state.buffer)
+}
+
+// offersSASL reports whether mechanism is among those advertised in the CAP
+// value, which depend on the listeners.
+func (server *Server) offersSASL(mechanism SASLMechanism) bool {
+	for _, offered := range strings.Split(server.capValues[SASL], ",") {
+		if string(mechanism) == offered {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) saslFinish(client *Client, account *Account) {
+	client.sasl = nil
+	if account == nil {
+		client.ErrSASLFail()
+	} else {
+		server.accountLogin(client, account.name)
+		client.RplSASLSuccess()
+	}
+	server.tryRegister(client)
+}
+
+func (server *Server) saslPlain(client *Client, response []byte) {
+	// authzid NUL authcid NUL passwd
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 {
+		server.saslFinish(client, nil)
+		return
+	}
+	authzid, authcid, password := Name(fields[0]), Name(fields[1]), fields[2]
+	if (authzid != "") && (authzid.ToLower() != authcid.ToLower()) {
+		server.saslFinish(client, nil)
+		return
+	}
+
+	account, err := server.accounts.Get(authcid)
+	if err != nil {
+		if err != ErrNoSuchAccount {
+			Log.error.Println("SASL PLAIN:", err)
+		}
+		server.saslFinish(client, nil)
+		return
+	}
+
+	state := client.sasl
+	state.pending = true
+	client.Bcrypt(func() error {
+		return account.CheckPassword(password)
+	}, func(err error) {
+		// The client may have aborted while the password was checked.
+		if client.sasl != state {
+			return
+		}
+		if err != nil {
+			account = nil
+		}
+		server.saslFinish(client, account)
+	})
+}
+
+func (server *Server) saslExternal(client *Client, response []byte) {
+	account, err := server.accounts.GetByCertFP(client.certfp)
+	if err != nil {
+		if err != ErrNoSuchAccount {
+			Log.error.Println("SASL EXTERNAL:", err)
+		}
+		server.saslFinish(client, nil)
+		return
+	}
+
+	// An authzid, if given, must name the certificate's account.
+	if authzid := Name(response); (authzid != "") &&
+		(authzid.ToLower() != account.name.ToLower()) {
+		account = nil
+	}
+	server.saslFinish(client, account)
+}
+
+//
+// commands
+//
+
+func (msg *AuthenticateCommand) HandleRegServer(server *Server) {
+	client := msg.Client()
+
+	if !client.capabilities[SASL] {
+		client.ErrSASLFail()
+		return
+	}
+
+	if client.account != "" {
+		client.ErrSASLAlready()
+		return
+	}
+
+	if msg.arg == "*" {
+		client.sasl = nil
+		client.ErrSASLAborted()
+		server.tryRegister(client)
+		return
+	}
+
+	if client.sasl == nil {
+		mechanism := SASLMechanism(strings.ToUpper(msg.arg))
+		if !server.offersSASL(mechanism) {
+			client.RplSASLMechs()
+			client.ErrSASLFail()
+			return
+		}
+		client.sasl = &SASLState{
+			mechanism: mechanism,
+		}
+		client.Reply(RplAuthenticate("+"))
+		return
+	}
+
+	state := client.sasl
+	if state.pending {
+		return
+	}
+	done, err := state.Add(msg.arg)
+	if err != nil {
+		client.sasl = nil
+		client.ErrSASLTooLong()
+		server.tryRegister(client)
+		return
+	}
+	if !done {
+		return
+	}
+
+	response, err := state.Response()
+	if err != nil {
+		server.saslFinish(client, nil)
+		return
+	}
+
+	switch state.mechanism {
+	case SASLPlain:
+		server.saslPlain(client, response)
+
+	case SASLExternal:
+		server.saslExternal(client, response)
+	}
+}
+
+func (msg *AuthenticateCommand) HandleServer(server *Server) {
+	msg.HandleRegServer(server)
+}
@@ -0,0 +1,87 @@
+package irc
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// saslChunks splits a response the way a client sends it.
+func saslChunks(response []byte) []string {
+	encoded := base64.StdEncoding.EncodeToString(response)
+	var chunks []string
+	for len(encoded) >= SASL_CHUNK_LEN {
+		chunks = append(chunks, encoded[:SASL_CHUNK_LEN])
+		encoded = encoded[SASL_CHUNK_LEN:]
+	}
+	if encoded == "" {
+		encoded = "+"
+	}
+	return append(chunks, encoded)
+}
+
+func TestSASLChunks(t *testing.T) {
+	// 300 bytes encode to exactly one full chunk, which needs a "+" after it.
+	tests := []struct {
+		name   string
+		length int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"short", 20, 1},
+		{"just under a chunk", 297, 1},
+		{"exactly one chunk", 300, 2},
+		{"one chunk and a bit", 301, 2},
+		{"exactly two chunks", 600, 3},
+		{"longest", SASL_MAX_LEN / 4 * 3, SASL_MAX_LEN/SASL_CHUNK_LEN + 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := []byte(strings.Repeat("x", test.length))
+			chunks := saslChunks(response)
+			if len(chunks) != test.chunks {
+				t.Fatalf("%d chunks, expected %d", len(chunks), test.chunks)
+			}
+
+			state := &SASLState{}
+			for index, chunk := range chunks {
+				done, err := state.Add(chunk)
+				if err != nil {
+					t.Fatalf("chunk %d: %s", index, err)
+				}
+				if last := index == len(chunks)-1; done != last {
+					t.Fatalf("chunk %d: done = %t, expected %t", index, done, last)
+				}
+			}
+
+			decoded, err := state.Response()
+			if err != nil {
+				t.Fatal("Response:", err)
+			}
+			if string(decoded) != string(response) {
+				t.Errorf("Response = %q, expected %q", decoded, response)
+			}
+		})
+	}
+}
+
+func TestSASLTooLong(t *testing.T) {
+	state := &SASLState{}
+	if _, err := state.Add(strings.Repeat("A", SASL_CHUNK_LEN+1)); err != ErrSASLTooLong {
+		t.Errorf("oversized chunk: err = %v, expected %v", err, ErrSASLTooLong)
+	}
+
+	state = &SASLState{}
+	chunk := strings.Repeat("A", SASL_CHUNK_LEN)
+	var err error
+	for length := 0; (err == nil) && (length <= SASL_MAX_LEN); length += len(chunk) {
+		_, err = state.Add(chunk)
+	}
+	if err != ErrSASLTooLong {
+		t.Errorf("oversized response: err = %v, expected %v", err, ErrSASLTooLong)
+	}
+	if len(state.buffer) > SASL_MAX_LEN {
+		t.Errorf("buffered %d bytes, expected at most %d", len(state.buffer), SASL_MAX_LEN)
+	}
+}
@@ -2,6 +2,7 @@ package irc
 
 import (
 	"bufio"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"log"
@@ -23,21 +24,50 @@ type RegServerCommand interface {
 	HandleRegServer(*Server)
 }
 
+const (
+	EXIT_SHUTDOWN = 0 // DIE or a signal
+	EXIT_RESTART  = 2 // RESTART, for a supervisor if re-exec fails
+
+	DEFAULT_QUIT_MESSAGE = "Server shutting down"
+)
+
 type Server struct {
-	channels  ChannelNameMap
-	clients   *ClientLookupSet
-	commands  chan Command
-	ctime     time.Time
-	db        *sql.DB
-	idle      chan *Client
-	motdFile  string
-	name      Name
-	newConns  chan net.Conn
-	operators map[Name][]byte
-	password  []byte
-	signals   chan os.Signal
-	whoWas    *WhoWasList
-	theaters  map[Name][]byte
+	accounts     *AccountStore
+	bans         *BanList
+	capabilities CapabilitySet
+	capValues    CapValues
+	chanServ     *Service
+	channels     *ChannelNameMap
+	clients      *ClientLookupSet
+	commands     chan Command
+	configFile   string
+	connLimit    *ConnectionLimiter
+	conns        ClientSet // registered or not
+	ctime        time.Time
+	db           *sql.DB
+	fakelag      *FakelagConfig
+	idle         chan *Client
+	inherited    []*os.File // kept open for the next process
+	isupport     ISupport
+	limits       *Limits
+	listeners    map[string]*ServerListener
+	motdFile     string
+	name         Name
+	newConns     chan net.Conn
+	operators    map[Name]*OperatorAuth
+	password     []byte
+	proxies      IPNets
+	quitMessage  Text
+	registry     *ChannelRegistry
+	restart      bool
+	nickServ     *Service
+	sendQ        int
+	services     ServiceMap
+	signals      chan os.Signal
+	stopped      bool
+	whoWas       *WhoWasList
+	theaters     map[Name][]byte
+	upgradeFile  string
 }
 
 var (
@@ -46,20 +76,44 @@ var (
 )
 
 func NewServer(config *Config) *Server {
+	// Before any name is folded.
+	SetCasemapping(config.Casemapping())
+	SetTrustedScripts(config.TrustedScripts())
+
+	limits := config.ProtocolLimits()
 	server := &Server{
-		channels:  make(ChannelNameMap),
-		clients:   NewClientLookupSet(),
-		commands:  make(chan Command),
-		ctime:     time.Now(),
-		db:        OpenDB(config.Server.Database),
-		idle:      make(chan *Client),
-		motdFile:  config.Server.MOTD,
-		name:      NewName(config.Server.Name),
-		newConns:  make(chan net.Conn),
-		operators: config.Operators(),
-		signals:   make(chan os.Signal, len(SERVER_SIGNALS)),
-		whoWas:    NewWhoWasList(100),
-		theaters:  config.Theaters(),
+		channels:    NewChannelNameMap(),
+		clients:     NewClientLookupSet(),
+		commands:    make(chan Command),
+		configFile:  config.filename,
+		connLimit:   NewConnectionLimiter(config.ConnectionLimits()),
+		conns:       make(ClientSet),
+		ctime:       time.Now(),
+		db:          OpenDB(config.Server.Database),
+		fakelag:     config.Fakelag(),
+		idle:        make(chan *Client),
+		isupport:    NewISupport(limits),
+		limits:      limits,
+		listeners:   make(map[string]*ServerListener),
+		motdFile:    config.Server.MOTD,
+		name:        NewName(config.Server.Name),
+		newConns:    make(chan net.Conn),
+		operators:   config.Operators(),
+		proxies:     config.Proxies(),
+		quitMessage: config.QuitMessage(),
+		sendQ:       config.SendQ(),
+		services:    make(ServiceMap),
+		signals:     make(chan os.Signal, len(SERVER_SIGNALS)),
+		whoWas:      NewWhoWasList(100),
+		theaters:    config.Theaters(),
+		upgradeFile: config.Server.Database + ".upgrade",
+	}
+
+	if err := CheckSchema(server.db); err != nil {
+		log.Fatal("database error: ", err)
+	}
+	if mapping, err := CheckCasemapping(server.db, config.Casemapping()); err != nil {
+		log.Fatalf("database error: %s (%s)", err, mapping)
 	}
 
 	if config.Server.Password != "" {
@@ -68,8 +122,34 @@ func NewServer(config *Config) *Server {
 
 	server.loadChannels()
 
-	for _, addr := range config.Server.Listen {
-		server.listen(addr)
+	server.accounts = NewAccountStore(server.db)
+	server.nickServ = NewNickServ(server)
+	server.services.Add(server.nickServ)
+	server.chanServ = NewChanServ(server)
+	server.services.Add(server.chanServ)
+
+	server.registry = NewChannelRegistry(server.db)
+	if err := server.registry.Load(); err != nil {
+		log.Fatal("error loading channel access: ", err)
+	}
+
+	server.bans = NewBanList(server.db)
+	if err := server.bans.Load(); err != nil {
+		log.Fatal("error loading bans: ", err)
+	}
+
+	server.capabilities, server.capValues = config.Capabilities()
+
+	listeners := config.Listeners()
+	state, err := LoadUpgradeState()
+	if err != nil {
+		log.Fatal("error loading upgrade state: ", err)
+	}
+	if state != nil {
+		server.resume(state, listeners)
+	}
+	if err := server.setListeners(listeners); err != nil {
+		log.Fatal(server, " ", err)
 	}
 
 	signal.Notify(server.signals, SERVER_SIGNALS...)
@@ -118,6 +198,7 @@ func (server *Server) loadChannels() {
 
 func (server *Server) processCommand(cmd Command) {
 	client := cmd.Client()
+	client.socket.Taken(cmd)
 
 	if !client.registered {
 		regCmd, ok := cmd.(RegServerCommand)
@@ -139,7 +220,7 @@ func (server *Server) processCommand(cmd Command) {
 	case *PingCommand, *PongCommand:
 		client.Touch()
 
-	case *QuitCommand:
+	case *QuitCommand, *BcryptCommand, *NickProtectCommand:
 		// no-op
 
 	default:
@@ -150,20 +231,101 @@ func (server *Server) processCommand(cmd Command) {
 	srvCmd.HandleServer(server)
 }
 
-func (server *Server) Shutdown() {
+// Shutdown stops listening, saves channels and closes every connection with
+// message, then waits up to CLOSE_TIMEOUT for the send queues to drain.
+func (server *Server) Shutdown(message Text) {
+	for addr, listener := range server.listeners {
+		listener.Stop()
+		delete(server.listeners, addr)
+	}
+
+	server.persistChannels()
+
+	sockets := make([]*Socket, 0, len(server.conns))
+	for client := range server.conns {
+		sockets = append(sockets, client.socket)
+		client.Quit(message)
+	}
+
+	if !WaitClosed(sockets, CLOSE_TIMEOUT) {
+		Log.warn.Printf("%s send queues not drained", server)
+	}
+
 	server.db.Close()
+	server.stopped = true
+}
+
+func (server *Server) persistChannels() {
+	for _, channel := range server.channels.byName {
+		if err := channel.Persist(); err != nil {
+			Log.error.Println("Channel.Persist:", channel, err)
+		}
+	}
+}
+
+// Rehash re-reads the config file. Operators, theaters, the server password,
+// the MOTD, the quit message, limits, capabilities, the log level and
+// listeners take effect; the name, database, casemapping and trusted scripts
+// need a restart. Opers get the privileges of their operator block as it is
+// now, or lose operator status if it is gone. Nothing changes if the config is
+// invalid, and a listener keeps its old certificate if the new one cannot be
+// loaded.
+func (server *Server) Rehash() error {
+	config, err := LoadConfig(server.configFile)
+	if err != nil {
+		return err
+	}
+
+	Log.SetLevel(config.Server.Log)
+
+	server.motdFile = config.Server.MOTD
+	server.operators = config.Operators()
 	for _, client := range server.clients.byNick {
-		client.Reply(RplNotice(server, client, "shutting down"))
+		server.checkOper(client)
+	}
+	server.password = nil
+	if config.Server.Password != "" {
+		server.password = config.Server.PasswordBytes()
+	}
+	server.quitMessage = config.QuitMessage()
+	server.theaters = config.Theaters()
+
+	if limits := config.ProtocolLimits(); *limits != *server.limits {
+		server.limits = limits
+		server.isupport = NewISupport(limits)
+		for _, channel := range server.channels.byName {
+			for _, list := range channel.lists {
+				list.max = limits.maxList
+			}
+		}
+		for _, client := range server.clients.byNick {
+			if client.registered {
+				client.RplISupport()
+			}
+		}
 	}
+
+	server.SetCapabilities(config.Capabilities())
+
+	// Listeners go last, since some may fail to start.
+	err = server.setListeners(config.Listeners())
+	Log.info.Printf("%s rehashed %s", server, server.configFile)
+	return err
 }
 
-func (server *Server) Run() {
-	done := false
-	for !done {
+// Run processes commands until the server shuts down, and returns the exit
+// status for the process.
+func (server *Server) Run() int {
+	for !server.stopped {
 		select {
-		case <-server.signals:
-			server.Shutdown()
-			done = true
+		case sig := <-server.signals:
+			if sig == syscall.SIGHUP {
+				if err := server.Rehash(); err != nil {
+					Log.error.Printf("%s rehash error: %s", server, err)
+				}
+			} else {
+				server.Shutdown(server.quitMessage)
+			}
 
 		case conn := <-server.newConns:
 			NewClient(server, conn)
@@ -175,24 +337,96 @@ func (server *Server) Run() {
 			client.Idle()
 		}
 	}
+
+	if server.restart {
+		return EXIT_RESTART
+	}
+	return EXIT_SHUTDOWN
 }
 
 //
 // listen goroutine
 //
 
-func (s *Server) listen(addr string) {
+// ServerListener is a running listener, kept so that a rehash can stop it.
+// Stopping it leaves the clients it accepted connected.
+type ServerListener struct {
+	net.Listener
+	config  ListenerConfig
+	stopped chan bool
+	tcp     *net.TCPListener // under any PROXY or TLS layers
+}
+
+func (listener *ServerListener) Stop() {
+	close(listener.stopped)
+	listener.Close()
+}
+
+func (listener *ServerListener) IsStopped() bool {
+	select {
+	case <-listener.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) listen(addr string, config *ListenerConfig) error {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal(s, "listen error: ", err)
+		return fmt.Errorf("listen error: %s", err)
+	}
+	return s.serve(addr, config, listener.(*net.TCPListener))
+}
+
+// serve accepts connections on a bound listener, which may have been
+// inherited from the server before an upgrade.
+func (s *Server) serve(addr string, config *ListenerConfig, tcp *net.TCPListener) error {
+	var listener net.Listener = tcp
+
+	// The PROXY header precedes any TLS or HTTP traffic.
+	if config.Proxy {
+		listener = &ProxyListener{
+			Listener: listener,
+			proxies:  s.proxies,
+		}
+	}
+
+	kind := "plaintext"
+	if config.IsTLS() {
+		tlsConfig, err := config.TLSConfig()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("tls error: %s", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		kind = "TLS"
+	}
+
+	serverListener := &ServerListener{
+		Listener: listener,
+		config:   *config,
+		stopped:  make(chan bool),
+		tcp:      tcp,
+	}
+	s.listeners[addr] = serverListener
+
+	if config.WebSocket {
+		Log.info.Printf("%s listening on %s (%s websocket)", s, addr, kind)
+		s.wsListen(serverListener)
+		return nil
 	}
 
-	Log.info.Printf("%s listening on %s", s, addr)
+	Log.info.Printf("%s listening on %s (%s)", s, addr, kind)
 
 	go func() {
 		for {
-			conn, err := listener.Accept()
+			conn, err := serverListener.Accept()
 			if err != nil {
+				if serverListener.IsStopped() {
+					Log.info.Printf("%s stopped listening on %s", s, addr)
+					return
+				}
 				Log.error.Printf("%s accept error: %s", s, err)
 				continue
 			}
@@ -201,6 +435,45 @@ func (s *Server) listen(addr string) {
 			s.newConns <- conn
 		}
 	}()
+	return nil
+}
+
+// setListeners stops listeners missing from listeners, or configured
+// differently, and starts the new ones. TLS listeners always restart, so that
+// renewed certificates are loaded, but one whose certificate cannot be loaded
+// keeps running as it was.
+func (server *Server) setListeners(listeners map[string]*ListenerConfig) (err error) {
+	fail := func(addr string, listenErr error) {
+		Log.error.Printf("%s %s %s", server, addr, listenErr)
+		if err == nil {
+			err = fmt.Errorf("%s %s", addr, listenErr)
+		}
+	}
+
+	for addr, listener := range server.listeners {
+		config := listeners[addr]
+		// TLS listeners restart anyway, to load renewed certificates.
+		if (config != nil) && (*config == listener.config) && !config.IsTLS() {
+			continue
+		}
+		if (config != nil) && config.IsTLS() {
+			if _, tlsErr := config.TLSConfig(); tlsErr != nil {
+				fail(addr, fmt.Errorf("tls error: %s", tlsErr))
+				continue
+			}
+		}
+		listener.Stop()
+		delete(server.listeners, addr)
+	}
+	for addr, config := range listeners {
+		if server.listeners[addr] != nil {
+			continue
+		}
+		if listenErr := server.listen(addr, config); listenErr != nil {
+			fail(addr, listenErr)
+		}
+	}
+	return
 }
 
 //
@@ -209,7 +482,13 @@ func (s *Server) listen(addr string) {
 
 func (s *Server) tryRegister(c *Client) {
 	if c.registered || !c.HasNick() || !c.HasUsername() ||
-		(c.capState == CapNegotiating) {
+		(c.capState == CapNegotiating) || (c.sasl != nil) {
+		return
+	}
+
+	if ban := s.bans.Match(KLine, c); ban != nil {
+		c.ErrYoureBannedCreep(ban)
+		c.Quit(NewText(fmt.Sprintf("K-Lined: %s", ban.reason)))
 		return
 	}
 
@@ -218,7 +497,9 @@ func (s *Server) tryRegister(c *Client) {
 	c.RplYourHost()
 	c.RplCreated()
 	c.RplMyInfo()
+	c.RplISupport()
 	s.MOTD(c)
+	s.checkNickProtection(c)
 }
 
 func (server *Server) MOTD(client *Client) {
@@ -294,7 +575,17 @@ func (msg *PassCommand) HandleRegServer(server *Server) {
 }
 
 func (msg *ProxyCommand) HandleRegServer(server *Server) {
-	msg.Client().hostname = msg.hostname
+	client := msg.Client()
+	if msg.fromClient {
+		client.Quit("PROXY not allowed")
+		return
+	}
+	client.hostname = msg.hostname
+
+	if ban := server.bans.Match(DLine, client); ban != nil {
+		client.ErrYoureBannedCreep(ban)
+		client.Quit(NewText(fmt.Sprintf("D-Lined: %s", ban.reason)))
+	}
 }
 
 func (msg *RFC1459UserCommand) HandleRegServer(server *Server) {
@@ -326,10 +617,6 @@ func (msg *RFC2812UserCommand) HandleRegServer(server *Server) {
 
 func (msg *UserCommand) setUserInfo(server *Server) {
 	client := msg.Client()
-	if client.capState == CapNegotiating {
-		client.capState = CapNegotiated
-	}
-
 	server.clients.Remove(client)
 	client.username, client.realname = msg.username, msg.realname
 	server.clients.Add(client)
@@ -377,13 +664,23 @@ func (m *JoinCommand) HandleServer(s *Server) {
 	}
 
 	for name, key := range m.channels {
-		if !name.IsChannel() {
+		if !s.limits.IsChannel(name) {
 			client.ErrNoSuchChannel(name)
 			continue
 		}
 
 		channel := s.channels.Get(name)
+		if (channel == nil) || !channel.members.Has(client) {
+			if uint(len(client.channels)) >= s.limits.channels {
+				client.ErrTooManyChannels(name)
+				continue
+			}
+		}
 		if channel == nil {
+			if s.channels.Confusable(name) != nil {
+				client.ErrUnavailResource(name)
+				continue
+			}
 			channel = NewChannel(s, name)
 		}
 		channel.Join(client, key)
@@ -428,7 +725,12 @@ func (msg *PrivMsgCommand) HandleServer(server *Server) {
 			return
 		}
 
-		channel.PrivMsg(client, msg.message)
+		channel.PrivMsg(client, msg.message, NewMessageTags(msg.tags.ClientOnly()))
+		return
+	}
+
+	if service := server.services.Get(msg.target); service != nil {
+		service.Handle(client, msg.message)
 		return
 	}
 
@@ -437,7 +739,8 @@ func (msg *PrivMsgCommand) HandleServer(server *Server) {
 		client.ErrNoSuchNick(msg.target)
 		return
 	}
-	target.Reply(RplPrivMsg(client, target, msg.message))
+	tags := NewMessageTags(msg.tags.ClientOnly())
+	target.Reply(RplTaggedPrivMsg(tags, client, target, msg.message))
 	if target.flags[Away] {
 		client.RplAway(target)
 	}
@@ -493,7 +796,7 @@ func (msg *WhoCommand) HandleServer(server *Server) {
 	mask := msg.mask
 
 	if mask == "" {
-		for _, channel := range server.channels {
+		for _, channel := range server.channels.byName {
 			whoChannel(client, channel, friends)
 		}
 	} else if mask.IsChannel() {
@@ -514,17 +817,31 @@ func (msg *WhoCommand) HandleServer(server *Server) {
 func (msg *OperCommand) HandleServer(server *Server) {
 	client := msg.Client()
 
-	if (msg.hash == nil) || (msg.err != nil) {
+	if !msg.IsAuthenticated() {
 		client.ErrPasswdMismatch()
 		return
 	}
 
+	operator := server.operators[msg.name]
+	if (operator.hostmasks != nil) && !operator.hostmasks.Match(client) {
+		client.ErrNoOperHost()
+		return
+	}
+
 	client.flags[Operator] = true
+	client.operClass = operator.class
+	client.operName = msg.name
+	client.fakelag.SetOper(true)
 	client.RplYoureOper()
 	client.Reply(RplModeChanges(client, client, ModeChanges{&ModeChange{
 		mode: Operator,
 		op:   Add,
 	}}))
+
+	if operator.vhost != "" {
+		client.ChangeHostname(operator.vhost)
+		client.RplHostHidden()
+	}
 }
 
 func (msg *AwayCommand) HandleServer(server *Server) {
@@ -576,7 +893,39 @@ func (msg *NoticeCommand) HandleServer(server *Server) {
 			return
 		}
 
-		channel.Notice(client, msg.message)
+		channel.Notice(client, msg.message, NewMessageTags(msg.tags.ClientOnly()))
+		return
+	}
+
+	// Services never answer a NOTICE.
+	if server.services.Get(msg.target) != nil {
+		return
+	}
+
+	target := server.clients.Get(msg.target)
+	if target == nil {
+		client.ErrNoSuchNick(msg.target)
+		return
+	}
+	tags := NewMessageTags(msg.tags.ClientOnly())
+	target.Reply(RplTaggedNotice(tags, client, target, msg.message))
+}
+
+func (msg *TagMsgCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if len(msg.tags.ClientOnly()) == 0 {
+		return
+	}
+	tags := NewMessageTags(msg.tags.ClientOnly())
+
+	if msg.target.IsChannel() {
+		channel := server.channels.Get(msg.target)
+		if channel == nil {
+			client.ErrNoSuchChannel(msg.target)
+			return
+		}
+
+		channel.TagMsg(client, tags)
 		return
 	}
 
@@ -585,7 +934,9 @@ func (msg *NoticeCommand) HandleServer(server *Server) {
 		client.ErrNoSuchNick(msg.target)
 		return
 	}
-	target.Reply(RplNotice(client, target, msg.message))
+	if target.capabilities[MessageTags] {
+		target.Reply(RplTagMsg(tags, client, target))
+	}
 }
 
 func (msg *KickCommand) HandleServer(server *Server) {
@@ -617,8 +968,8 @@ func (msg *ListCommand) HandleServer(server *Server) {
 	}
 
 	if len(msg.channels) == 0 {
-		for _, channel := range server.channels {
-			if !client.flags[Operator] && channel.flags[Private] {
+		for _, channel := range server.channels.byName {
+			if !client.HasPrivilege(PrivSeePrivate) && channel.flags[Private] {
 				continue
 			}
 			client.RplList(channel)
@@ -626,7 +977,7 @@ func (msg *ListCommand) HandleServer(server *Server) {
 	} else {
 		for _, chname := range msg.channels {
 			channel := server.channels.Get(chname)
-			if channel == nil || (!client.flags[Operator] && channel.flags[Private]) {
+			if channel == nil || (!client.HasPrivilege(PrivSeePrivate) && channel.flags[Private]) {
 				client.ErrNoSuchChannel(chname)
 				continue
 			}
@@ -638,8 +989,8 @@ func (msg *ListCommand) HandleServer(server *Server) {
 
 func (msg *NamesCommand) HandleServer(server *Server) {
 	client := msg.Client()
-	if len(server.channels) == 0 {
-		for _, channel := range server.channels {
+	if len(server.channels.byName) == 0 {
+		for _, channel := range server.channels.byName {
 			channel.Names(client)
 		}
 		return
@@ -663,6 +1014,7 @@ func (msg *VersionCommand) HandleServer(server *Server) {
 	}
 
 	client.RplVersion()
+	client.RplISupport()
 }
 
 func (msg *InviteCommand) HandleServer(server *Server) {
@@ -693,9 +1045,46 @@ func (msg *TimeCommand) HandleServer(server *Server) {
 	client.RplTime()
 }
 
+func (msg *RehashCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if !client.HasPrivilege(PrivRehash) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	client.RplRehashing(server.configFile)
+	if err := server.Rehash(); err != nil {
+		client.Reply(RplNotice(server, client,
+			NewText(fmt.Sprintf("rehash error: %s", err))))
+	}
+}
+
+func (msg *DieCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if !client.HasPrivilege(PrivDie) {
+		client.ErrNoPrivileges()
+		return
+	}
+
+	message := server.quitMessage
+	if msg.message != "" {
+		message = msg.message
+	}
+	Log.info.Printf("%s %s by %s: %s", server, msg.Code(), client, message)
+	server.restart = msg.restart
+	if msg.upgrade {
+		err := server.Upgrade(message)
+		if err == nil {
+			return
+		}
+		Log.error.Printf("%s upgrade error: %s", server, err)
+	}
+	server.Shutdown(message)
+}
+
 func (msg *KillCommand) HandleServer(server *Server) {
 	client := msg.Client()
-	if !client.flags[Operator] {
+	if !client.HasPrivilege(PrivKill) {
 		client.ErrNoPrivileges()
 		return
 	}
@@ -724,3 +1113,23 @@ func (msg *WhoWasCommand) HandleServer(server *Server) {
 		client.RplEndOfWhoWas(nickname)
 	}
 }
+
+func (msg *StatsCommand) HandleServer(server *Server) {
+	client := msg.Client()
+	if (msg.target != "") && (msg.target != server.name) {
+		client.ErrNoSuchServer(msg.target)
+		return
+	}
+
+	switch msg.query {
+	case "k", "K", "d", "D":
+		if !client.HasPrivilege(PrivBan) {
+			client.ErrNoPrivileges()
+			return
+		}
+		for _, ban := range server.bans.Bans(BanKind(strings.ToUpper(msg.query)[0])) {
+			client.RplStatsBan(ban)
+		}
+	}
+	client.RplEndOfStats(msg.query)
+}
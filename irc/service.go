@@ -0,0 +1,88 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ServiceCommandFunc handles one command sent to a service. args excludes
+// the command name.
+type ServiceCommandFunc func(service *Service, client *Client, args []string)
+
+// Service is a pseudo-client run by the server, such as NickServ. Users
+// talk to it with PRIVMSG and it answers with NOTICE.
+type Service struct {
+	commands map[string]ServiceCommandFunc
+	help     []string
+	name     Name
+	server   *Server
+}
+
+func NewService(server *Server, name Name, commands map[string]ServiceCommandFunc,
+	help []string) *Service {
+	return &Service{
+		commands: commands,
+		help:     help,
+		name:     name,
+		server:   server,
+	}
+}
+
+func (service *Service) Id() Name {
+	return Name(fmt.Sprintf("%s!%s@%s", service.name, service.name, service.server.name))
+}
+
+func (service *Service) Nick() Name {
+	return service.name
+}
+
+func (service *Service) String() string {
+	return service.Id().String()
+}
+
+func (service *Service) Notice(client *Client, format string, args ...interface{}) {
+	client.Reply(RplNotice(service, client, NewText(fmt.Sprintf(format, args...))))
+}
+
+func (service *Service) Handle(client *Client, message Text) {
+	args := strings.Fields(message.String())
+	if len(args) == 0 {
+		return
+	}
+
+	name := strings.ToUpper(args[0])
+	if name == "HELP" {
+		for _, line := range service.help {
+			service.Notice(client, "%s", line)
+		}
+		return
+	}
+
+	command, ok := service.commands[name]
+	if !ok {
+		service.Notice(client, "Unknown command %s. Try HELP.", args[0])
+		return
+	}
+	command(service, client, args[1:])
+}
+
+type ServiceMap map[Name]*Service
+
+func (services ServiceMap) Get(name Name) *Service {
+	return services[name.ToLower()]
+}
+
+func (services ServiceMap) Add(service *Service) {
+	services[service.name.ToLower()] = service
+}
+
+// Confusable finds the service whose nick looks like name.
+func (services ServiceMap) Confusable(name Name) *Service {
+	skeleton := name.Skeleton()
+	for _, service := range services {
+		if service.name.Skeleton() == skeleton {
+			return service
+		}
+	}
+	return nil
+}
@@ -2,45 +2,254 @@ package irc
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	R = '→'
 	W = '←'
+
+	DEFAULT_SENDQ = 64 * 1024       // bytes queued before a client is dropped
+	CLOSE_TIMEOUT = 5 * time.Second // how long a closing socket may flush
+)
+
+var (
+	ErrNotDetachable = errors.New("not a plain TCP connection")
+	ErrSendQExceeded = errors.New("SendQ exceeded")
 )
 
+// Socket reads lines on the client goroutine. Writes are queued and drained
+// by a writer goroutine so a slow peer never blocks the server goroutine.
 type Socket struct {
-	closed  bool
-	conn    net.Conn
-	scanner *bufio.Scanner
-	writer  *bufio.Writer
+	closed     bool
+	conn       net.Conn
+	detached   bool      // closed, but the connection is left open
+	done       chan bool // closed when the writer goroutine exits
+	mutex      sync.Mutex
+	pending    string  // the last line read, until the server takes its command
+	pendingCmd Command // parsed from pending
+	readMutex  sync.Mutex
+	scanner    *bufio.Scanner
+	sendQ      []string
+	sendQLen   int // bytes queued or being written
+	sendQMax   int
+	unread     []byte // scanned, but not yet returned as a line
+	wake       chan bool
+	writer     *bufio.Writer
 }
 
-func NewSocket(conn net.Conn) *Socket {
-	return &Socket{
-		conn:    conn,
-		scanner: bufio.NewScanner(conn),
-		writer:  bufio.NewWriter(conn),
+func NewSocket(conn net.Conn, sendQMax int) *Socket {
+	socket := &Socket{
+		conn:     conn,
+		done:     make(chan bool),
+		sendQMax: sendQMax,
+		wake:     make(chan bool, 1),
+		writer:   bufio.NewWriter(conn),
 	}
+	socket.setReader(conn)
+	go socket.writeLoop()
+	return socket
+}
+
+func (socket *Socket) setReader(reader io.Reader) {
+	socket.scanner = bufio.NewScanner(reader)
+	socket.scanner.Split(socket.scanLines)
 }
 
 func (socket *Socket) String() string {
 	return socket.conn.RemoteAddr().String()
 }
 
+// Close lets the writer goroutine flush what is queued, up to CLOSE_TIMEOUT,
+// before closing the connection.
 func (socket *Socket) Close() {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
 	if socket.closed {
 		return
 	}
 	socket.closed = true
+	socket.conn.SetWriteDeadline(time.Now().Add(CLOSE_TIMEOUT))
+	socket.signal()
+}
+
+// WaitClosed waits up to timeout for the sockets to flush and close, and
+// reports whether they all did.
+func WaitClosed(sockets []*Socket, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for _, socket := range sockets {
+		select {
+		case <-socket.done:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// Detach stops the socket without closing the connection, which File then
+// hands over once the send queue is flushed. Input read from the connection
+// but not yet handled is kept for Unhandled.
+func (socket *Socket) Detach() error {
+	if socket.tcpConn() == nil {
+		return ErrNotDetachable
+	}
+
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	if socket.closed {
+		return io.EOF
+	}
+	socket.closed = true
+	socket.detached = true
+	socket.conn.SetReadDeadline(time.Now())
+	socket.conn.SetWriteDeadline(time.Now().Add(CLOSE_TIMEOUT))
+	socket.signal()
+	return nil
+}
+
+// File waits, up to CLOSE_TIMEOUT, for a detached socket to flush and returns
+// its connection as a file for another process.
+func (socket *Socket) File() (*os.File, error) {
+	<-socket.done
+	socket.mutex.Lock()
+	detached := socket.detached
+	socket.mutex.Unlock()
+	if !detached {
+		return nil, io.EOF
+	}
+	return socket.tcpConn().File()
+}
+
+// Unhandled returns the input of a detached socket that the server never
+// handled: the pending line, unless the server took its command, and whatever
+// followed it. The next process reads it again with Replay.
+func (socket *Socket) Unhandled() string {
+	// Read returns soon after Detach, and the scanner stays put after that.
+	socket.readMutex.Lock()
+	defer socket.readMutex.Unlock()
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	if socket.pending == "" {
+		return string(socket.unread)
+	}
+	return socket.pending + CRLF + string(socket.unread)
+}
+
+// Replay makes the socket read input before anything from the connection. It
+// must be called before the first Read.
+func (socket *Socket) Replay(input string) {
+	socket.setReader(io.MultiReader(strings.NewReader(input), socket.conn))
+}
+
+// Pending tells the socket that command was parsed from the last line read.
+// The line counts as unhandled until the server calls Taken with it.
+func (socket *Socket) Pending(command Command) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.pendingCmd = command
+}
+
+// Taken tells the socket that the server has command, so the line it was
+// parsed from is handled.
+func (socket *Socket) Taken(command Command) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	if (socket.pendingCmd != nil) && (socket.pendingCmd == command) {
+		socket.pending, socket.pendingCmd = "", nil
+	}
+}
+
+func (socket *Socket) setPending(line string) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	socket.pending, socket.pendingCmd = line, nil
+}
+
+// CloseDetached closes the connection of a detached socket whose handoff
+// failed.
+func (socket *Socket) CloseDetached() {
+	<-socket.done
 	socket.conn.Close()
-	Log.debug.Printf("%s closed", socket)
+}
+
+func (socket *Socket) tcpConn() *net.TCPConn {
+	conn := socket.conn
+	if proxyConn, ok := conn.(*ProxyConn); ok {
+		conn = proxyConn.Conn
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+func (socket *Socket) isClosed() bool {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return socket.closed
+}
+
+func (socket *Socket) isDetached() bool {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return socket.detached
+}
+
+// SendQ reports the bytes and lines waiting to be written.
+func (socket *Socket) SendQ() (length int, lines int) {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
+	return socket.sendQLen, len(socket.sendQ)
+}
+
+// ReadProxyHeader consumes the PROXY header of a connection from a proxied
+// listener. It must run before anything else reads from the connection.
+func (socket *Socket) ReadProxyHeader() error {
+	conn := socket.conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if proxyConn, ok := conn.(*ProxyConn); ok {
+		return proxyConn.ReadHeader()
+	}
+	return nil
+}
+
+// CertFP completes the TLS handshake, if any, and returns the hex SHA-256
+// fingerprint of the peer certificate. It is empty when the client did not
+// present one.
+func (socket *Socket) CertFP() (certfp string, err error) {
+	tlsConn, ok := socket.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+
+	if err = tlsConn.Handshake(); socket.isError(err, R) {
+		return
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	certfp = hex.EncodeToString(sum[:])
+	return
 }
 
 func (socket *Socket) Read() (line string, err error) {
-	if socket.closed {
+	socket.readMutex.Lock()
+	defer socket.readMutex.Unlock()
+	socket.setPending("")
+	if socket.isClosed() {
 		err = io.EOF
 		return
 	}
@@ -51,6 +260,7 @@ func (socket *Socket) Read() (line string, err error) {
 			continue
 		}
 		Log.debug.Printf("%s → %s", socket, line)
+		socket.setPending(line)
 		return
 	}
 
@@ -62,25 +272,100 @@ func (socket *Socket) Read() (line string, err error) {
 	return
 }
 
-func (socket *Socket) Write(line string) (err error) {
+// scanLines splits lines like bufio.ScanLines, and remembers what is left
+// after each line. Once the socket is detached, a final partial line is left
+// too, rather than read as a line.
+func (socket *Socket) scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && socket.isDetached() {
+		socket.unread = data
+		return 0, nil, io.EOF
+	}
+	advance, token, err = bufio.ScanLines(data, atEOF)
+	socket.unread = data[advance:]
+	return
+}
+
+// Write queues a line without blocking. It fails once the queue would grow
+// past the sendq limit.
+func (socket *Socket) Write(line string) error {
+	socket.mutex.Lock()
+	defer socket.mutex.Unlock()
 	if socket.closed {
-		err = io.EOF
-		return
+		return io.EOF
 	}
 
-	if _, err = socket.writer.WriteString(line); socket.isError(err, W) {
-		return
+	length := len(line) + len(CRLF)
+	if (socket.sendQLen + length) > socket.sendQMax {
+		return ErrSendQExceeded
 	}
+	socket.sendQ = append(socket.sendQ, line)
+	socket.sendQLen += length
+	socket.signal()
+	return nil
+}
 
-	if _, err = socket.writer.WriteString(CRLF); socket.isError(err, W) {
-		return
+func (socket *Socket) signal() {
+	select {
+	case socket.wake <- true:
+	default:
+	}
+}
+
+//
+// writer goroutine
+//
+
+func (socket *Socket) writeLoop() {
+	var err error
+	for range socket.wake {
+		socket.mutex.Lock()
+		lines, closed := socket.sendQ, socket.closed
+		socket.sendQ = nil
+		socket.mutex.Unlock()
+
+		var length int
+		length, err = socket.writeLines(lines)
+
+		socket.mutex.Lock()
+		socket.sendQLen -= length
+		if err != nil {
+			socket.closed, closed = true, true
+		}
+		socket.mutex.Unlock()
+
+		if closed {
+			break
+		}
+	}
+	socket.mutex.Lock()
+	socket.detached = socket.detached && (err == nil)
+	detached := socket.detached
+	socket.mutex.Unlock()
+
+	if detached {
+		Log.debug.Printf("%s detached", socket)
+	} else {
+		socket.conn.Close()
+		Log.debug.Printf("%s closed", socket)
+	}
+	close(socket.done)
+}
+
+func (socket *Socket) writeLines(lines []string) (length int, err error) {
+	for _, line := range lines {
+		length += len(line) + len(CRLF)
+		if _, err = socket.writer.WriteString(line); socket.isError(err, W) {
+			return
+		}
+		if _, err = socket.writer.WriteString(CRLF); socket.isError(err, W) {
+			return
+		}
+		Log.debug.Printf("%s ← %s", socket, line)
 	}
 
 	if err = socket.writer.Flush(); socket.isError(err, W) {
 		return
 	}
-
-	Log.debug.Printf("%s ← %s", socket, line)
 	return
 }
 
@@ -2,16 +2,88 @@ package irc
 
 import (
 	"code.google.com/p/go.text/unicode/norm"
+	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 )
 
+const (
+	CHANTYPES = "&!#+"
+)
+
+var (
+	// regexps; lengths are checked against the configured Limits.
+	ChannelNameExpr = regexp.MustCompile(fmt.Sprintf(`^[%s][\pL\pN]+$`,
+		regexp.QuoteMeta(CHANTYPES)))
+	NicknameExpr = regexp.MustCompile(`^[\pL\pN\pP\pS]+$`)
+)
+
+// Casemapping decides which names are the same nick or channel. It is set
+// once at startup and applies to every name comparison.
+type Casemapping string
+
+const (
+	CasemappingASCII   Casemapping = "ascii"   // A-Z only
+	CasemappingRFC1459 Casemapping = "rfc1459" // ascii, and []\~ as {}|^
+	CasemappingPrecis  Casemapping = "precis"  // all of Unicode, NFKC
+)
+
 var (
-	// regexps
-	ChannelNameExpr = regexp.MustCompile(`^[&!#+][\pL\pN]{1,63}$`)
-	NicknameExpr    = regexp.MustCompile("^[\\pL\\pN\\pP\\pS]{1,32}$")
+	ErrNoSuchCasemapping = errors.New("no such casemapping")
+
+	casemapping = CasemappingPrecis
+
+	asciiFolder   = strings.NewReplacer(asciiPairs("")...)
+	rfc1459Folder = strings.NewReplacer(asciiPairs(`[{]}\|~^`)...)
 )
 
+func asciiPairs(extra string) []string {
+	pairs := []string{}
+	for upper := 'A'; upper <= 'Z'; upper += 1 {
+		pairs = append(pairs, string(upper), string(upper+'a'-'A'))
+	}
+	for _, char := range extra {
+		pairs = append(pairs, string(char))
+	}
+	return pairs
+}
+
+func ParseCasemapping(str string) (Casemapping, error) {
+	switch mapping := Casemapping(strings.ToLower(str)); mapping {
+	case "":
+		return CasemappingPrecis, nil
+
+	case CasemappingASCII, CasemappingRFC1459, CasemappingPrecis:
+		return mapping, nil
+	}
+	return "", ErrNoSuchCasemapping
+}
+
+func SetCasemapping(mapping Casemapping) {
+	casemapping = mapping
+}
+
+// ISupportString is the CASEMAPPING token value.
+func (mapping Casemapping) ISupportString() string {
+	if mapping == CasemappingPrecis {
+		return "rfc8265"
+	}
+	return string(mapping)
+}
+
+func (mapping Casemapping) Fold(str string) string {
+	switch mapping {
+	case CasemappingASCII:
+		return asciiFolder.Replace(str)
+
+	case CasemappingRFC1459:
+		return rfc1459Folder.Replace(str)
+	}
+	// Lowercasing can denormalize, e.g. the Kelvin sign.
+	return norm.NFKC.String(strings.ToLower(norm.NFKC.String(str)))
+}
+
 // Names are normalized and canonicalized to remove formatting marks
 // and simplify usage. They are things like hostnames and usermasks.
 type Name string
@@ -44,8 +116,9 @@ func (name Name) String() string {
 	return string(name)
 }
 
+// ToLower folds a name by the server's casemapping.
 func (name Name) ToLower() Name {
-	return Name(strings.ToLower(name.String()))
+	return Name(casemapping.Fold(name.String()))
 }
 
 // It's safe to coerce a Name to Text. Name is a strict subset of Text.
@@ -0,0 +1,57 @@
+package irc
+
+import (
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		mapping Casemapping
+		str     string
+		folded  string
+	}{
+		{CasemappingASCII, "Nick", "nick"},
+		{CasemappingASCII, `[]\~`, `[]\~`},
+		{CasemappingASCII, "\u00c4ND", "\u00c4nd"}, // only A-Z
+		{CasemappingASCII, "\u212a", "\u212a"},     // Kelvin sign
+
+		{CasemappingRFC1459, "Nick", "nick"},
+		{CasemappingRFC1459, `[]\~`, "{}|^"},
+		{CasemappingRFC1459, "{}|^", "{}|^"},
+		{CasemappingRFC1459, "\u00c4ND", "\u00c4nd"},
+
+		{CasemappingPrecis, "Nick", "nick"},
+		{CasemappingPrecis, `[]\~`, `[]\~`},
+		{CasemappingPrecis, "\u00c4ND", "\u00e4nd"},
+		{CasemappingPrecis, "A\u0308ND", "\u00e4nd"},            // decomposed
+		{CasemappingPrecis, "\u212a", "k"},                      // Kelvin sign
+		{CasemappingPrecis, "\uff2e\uff49\uff43\uff4b", "nick"}, // fullwidth
+	}
+	for _, test := range tests {
+		if folded := test.mapping.Fold(test.str); folded != test.folded {
+			t.Errorf("%s: Fold(%q) = %q, expected %q",
+				test.mapping, test.str, folded, test.folded)
+		}
+	}
+}
+
+func TestParseCasemapping(t *testing.T) {
+	tests := []struct {
+		str     string
+		mapping Casemapping
+		err     error
+	}{
+		{"", CasemappingPrecis, nil},
+		{"ascii", CasemappingASCII, nil},
+		{"RFC1459", CasemappingRFC1459, nil},
+		{"precis", CasemappingPrecis, nil},
+		{"strict-rfc1459", "", ErrNoSuchCasemapping},
+	}
+	for _, test := range tests {
+		mapping, err := ParseCasemapping(test.str)
+		if (mapping != test.mapping) || (err != test.err) {
+			t.Errorf("ParseCasemapping(%q) = %q, %v, expected %q, %v",
+				test.str, mapping, err, test.mapping, test.err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_TAGS_LEN        = 8191 // including the leading '@'
+	MAX_CLIENT_TAGS_LEN = 4094
+)
+
+const (
+	SERVER_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	msgIDEncoding   = base32.StdEncoding.WithPadding(base32.NoPadding)
+	ErrInputTooLong = errors.New("input line too long")
+	tagEscaper      = strings.NewReplacer(
+		`\`, `\\`,
+		`;`, `\:`,
+		" ", `\s`,
+		"\r", `\r`,
+		"\n", `\n`)
+)
+
+// Tags are IRCv3 message tags. A tag without a value maps to "".
+type Tags map[string]string
+
+// ParseTags reads the tag section of a line without its leading '@'. Later
+// duplicates win.
+func ParseTags(str string) Tags {
+	tags := make(Tags)
+	for _, tag := range strings.Split(str, ";") {
+		if tag == "" {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) > 1 {
+			tags[parts[0]] = UnescapeTagValue(parts[1])
+		} else {
+			tags[parts[0]] = ""
+		}
+	}
+	return tags
+}
+
+// NewMessageTags copies `base` and adds the server-time and msgid tags. A
+// relayed message gets one set of tags, shared by all of its recipients.
+func NewMessageTags(base Tags) Tags {
+	tags := make(Tags, len(base)+2)
+	for key, value := range base {
+		tags[key] = value
+	}
+	tags["time"] = time.Now().UTC().Format(SERVER_TIME_FORMAT)
+	tags["msgid"] = NewMsgID()
+	return tags
+}
+
+// NewMsgID returns 128 random bits, unique across servers and restarts.
+func NewMsgID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		Log.error.Println("NewMsgID:", err)
+	}
+	return strings.ToLower(msgIDEncoding.EncodeToString(buf))
+}
+
+func EscapeTagValue(value string) string {
+	return tagEscaper.Replace(value)
+}
+
+// UnescapeTagValue reverses EscapeTagValue. An unknown escape is the escaped
+// character itself and a trailing lone backslash is dropped.
+func UnescapeTagValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var buf []byte
+	for index := 0; index < len(value); index += 1 {
+		if value[index] != '\\' {
+			buf = append(buf, value[index])
+			continue
+		}
+		index += 1
+		if index >= len(value) {
+			break
+		}
+		switch value[index] {
+		case ':':
+			buf = append(buf, ';')
+		case 's':
+			buf = append(buf, ' ')
+		case 'r':
+			buf = append(buf, '\r')
+		case 'n':
+			buf = append(buf, '\n')
+		default:
+			buf = append(buf, value[index])
+		}
+	}
+	return string(buf)
+}
+
+// IsClientOnly reports whether a tag is a client-only tag, which servers
+// relay without interpreting.
+func IsClientOnly(key string) bool {
+	return strings.HasPrefix(key, "+")
+}
+
+func (tags Tags) ClientOnly() Tags {
+	clientTags := make(Tags)
+	for key, value := range tags {
+		if IsClientOnly(key) {
+			clientTags[key] = value
+		}
+	}
+	return clientTags
+}
+
+// String serializes tags in key order, without the leading '@'.
+func (tags Tags) String() string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	strs := make([]string, len(keys))
+	for index, key := range keys {
+		if tags[key] == "" {
+			strs[index] = key
+		} else {
+			strs[index] = key + "=" + EscapeTagValue(tags[key])
+		}
+	}
+	return strings.Join(strs, ";")
+}
+
+// A client only receives the tags it negotiated capabilities for.
+// message-tags allows all of them except account, which needs account-tag.
+func (client *Client) AllowsTag(key string) bool {
+	switch key {
+	case "account":
+		return client.capabilities[AccountTag]
+
+	case "time":
+		return client.capabilities[ServerTime] || client.capabilities[MessageTags]
+	}
+	return client.capabilities[MessageTags]
+}
+
+// filterTags removes the tags a client may not receive from a serialized
+// reply, and the tag section entirely if none are left.
+func (client *Client) filterTags(reply string) string {
+	if !strings.HasPrefix(reply, "@") {
+		return reply
+	}
+	tagStr, rest := splitArg(reply[len("@"):])
+	tags := ParseTags(tagStr)
+	for key := range tags {
+		if !client.AllowsTag(key) {
+			delete(tags, key)
+		}
+	}
+	if len(tags) == 0 {
+		return rest
+	}
+	return "@" + tags.String() + " " + rest
+}
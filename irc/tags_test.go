@@ -0,0 +1,89 @@
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagValueEscaping(t *testing.T) {
+	tests := []struct {
+		value   string
+		escaped string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"a;b", `a\:b`},
+		{"a b", `a\sb`},
+		{`a\b`, `a\\b`},
+		{"a\r\nb", `a\r\nb`},
+		{`; \`, `\:\s\\`},
+		{"ünïcode", "ünïcode"},
+	}
+	for _, test := range tests {
+		if escaped := EscapeTagValue(test.value); escaped != test.escaped {
+			t.Errorf("EscapeTagValue(%q) = %q, expected %q", test.value, escaped, test.escaped)
+		}
+		if value := UnescapeTagValue(test.escaped); value != test.value {
+			t.Errorf("UnescapeTagValue(%q) = %q, expected %q", test.escaped, value, test.value)
+		}
+	}
+}
+
+func TestUnescapeTagValueLenient(t *testing.T) {
+	tests := []struct {
+		escaped string
+		value   string
+	}{
+		{`a\b`, "ab"},  // unknown escape
+		{`a\`, "a"},    // trailing backslash
+		{`\\\`, `\`},   // escaped backslash, then a trailing one
+		{`\:\`, ";"},   // known escape, then a trailing backslash
+		{`\s\s`, "  "}, // consecutive escapes
+	}
+	for _, test := range tests {
+		if value := UnescapeTagValue(test.escaped); value != test.value {
+			t.Errorf("UnescapeTagValue(%q) = %q, expected %q", test.escaped, value, test.value)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		str  string
+		tags Tags
+	}{
+		{"", Tags{}},
+		{"a", Tags{"a": ""}},
+		{"a=", Tags{"a": ""}},
+		{"a=1;b=2", Tags{"a": "1", "b": "2"}},
+		{"a=1;a=2", Tags{"a": "2"}},
+		{";a=1;;", Tags{"a": "1"}},
+		{"=1;a=x=y", Tags{"a": "x=y"}},
+		{`+example.com/x=a\sb\:c`, Tags{"+example.com/x": "a b;c"}},
+	}
+	for _, test := range tests {
+		if tags := ParseTags(test.str); !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("ParseTags(%q) = %v, expected %v", test.str, tags, test.tags)
+		}
+	}
+}
+
+func TestTagsString(t *testing.T) {
+	tests := []struct {
+		tags Tags
+		str  string
+	}{
+		{Tags{}, ""},
+		{Tags{"a": ""}, "a"},
+		{Tags{"b": "2", "a": "1"}, "a=1;b=2"},
+		{Tags{"msg": "hi there; bye"}, `msg=hi\sthere\:\sbye`},
+	}
+	for _, test := range tests {
+		if str := test.tags.String(); str != test.str {
+			t.Errorf("%v.String() = %q, expected %q", test.tags, str, test.str)
+		}
+		if tags := ParseTags(test.str); !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("ParseTags(%q) = %v, expected %v", test.str, tags, test.tags)
+		}
+	}
+}
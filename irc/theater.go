@@ -77,7 +77,8 @@ func (m *TheaterPrivMsgCommand) HandleServer(s *Server) {
 		return
 	}
 
-	reply := RplPrivMsg(TheaterClient(m.asNick), channel, m.message)
+	reply := RplTaggedPrivMsg(NewMessageTags(nil), TheaterClient(m.asNick), channel,
+		m.message)
 	for member := range channel.members {
 		member.Reply(reply)
 	}
@@ -9,25 +9,47 @@ import (
 // simple types
 //
 
-type ChannelNameMap map[Name]*Channel
+type ChannelNameMap struct {
+	byName     map[Name]*Channel
+	bySkeleton map[string]*Channel
+}
+
+func NewChannelNameMap() *ChannelNameMap {
+	return &ChannelNameMap{
+		byName:     make(map[Name]*Channel),
+		bySkeleton: make(map[string]*Channel),
+	}
+}
 
-func (channels ChannelNameMap) Get(name Name) *Channel {
-	return channels[name.ToLower()]
+func (channels *ChannelNameMap) Get(name Name) *Channel {
+	return channels.byName[name.ToLower()]
 }
 
-func (channels ChannelNameMap) Add(channel *Channel) error {
-	if channels[channel.name.ToLower()] != nil {
+// Confusable finds the channel whose name looks like name, which may be the
+// channel called name itself.
+func (channels *ChannelNameMap) Confusable(name Name) *Channel {
+	return channels.bySkeleton[name.Skeleton()]
+}
+
+func (channels *ChannelNameMap) Add(channel *Channel) error {
+	if channels.Get(channel.name) != nil {
 		return fmt.Errorf("%s: already set", channel.name)
 	}
-	channels[channel.name.ToLower()] = channel
+	channels.byName[channel.name.ToLower()] = channel
+	if skeleton := channel.name.Skeleton(); channels.bySkeleton[skeleton] == nil {
+		channels.bySkeleton[skeleton] = channel
+	}
 	return nil
 }
 
-func (channels ChannelNameMap) Remove(channel *Channel) error {
-	if channel != channels[channel.name.ToLower()] {
+func (channels *ChannelNameMap) Remove(channel *Channel) error {
+	if channel != channels.Get(channel.name) {
 		return fmt.Errorf("%s: mismatch", channel.name)
 	}
-	delete(channels, channel.name.ToLower())
+	delete(channels.byName, channel.name.ToLower())
+	if skeleton := channel.name.Skeleton(); channels.bySkeleton[skeleton] == channel {
+		delete(channels.bySkeleton, skeleton)
+	}
 	return nil
 }
 
@@ -0,0 +1,369 @@
+package irc
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	UPGRADE_ENV = "ERGONOMADIC_UPGRADE" // path of the state file
+)
+
+// UpgradeState is what a server hands to its replacement on RESTART UPGRADE,
+// along with the listener and client file descriptors it names. Only plain
+// TCP clients that finished registering are kept; TLS and WebSocket sessions
+// cannot leave the process.
+type UpgradeState struct {
+	Channels  []*ChannelState
+	Clients   []*ClientState
+	Created   time.Time
+	Listeners map[string]uintptr // address to file descriptor
+}
+
+type ClientState struct {
+	Account      string
+	AwayMessage  string
+	Capabilities []Capability
+	CapVersion   int
+	Created      time.Time
+	FD           uintptr
+	Flags        string // user modes
+	Hostname     string
+	IP           string
+	Nick         string
+	OperClass    []OperPrivilege
+	OperName     string
+	Realname     string
+	Unhandled    string // input the previous server read but did not handle
+	Username     string
+}
+
+type ChannelState struct {
+	Bans      string
+	Excepts   string
+	Flags     string
+	Invites   string
+	Key       string
+	Members   map[string]string // nick to channel modes
+	Name      string
+	Topic     string
+	UserLimit uint64
+}
+
+// inherit keeps a file open across exec. The file is also kept referenced
+// until then, since its finalizer would close it.
+func (server *Server) inherit(file *os.File) (uintptr, error) {
+	fd := file.Fd()
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	server.inherited = append(server.inherited, file)
+	return fd, nil
+}
+
+func (client *Client) State(fd uintptr) *ClientState {
+	state := &ClientState{
+		Account:     client.account.String(),
+		AwayMessage: client.awayMessage.String(),
+		CapVersion:  client.capVersion,
+		Created:     client.ctime,
+		FD:          fd,
+		Hostname:    client.hostname.String(),
+		Nick:        client.nick.String(),
+		OperName:    client.operName.String(),
+		Realname:    client.realname.String(),
+		Unhandled:   client.socket.Unhandled(),
+		Username:    client.username.String(),
+	}
+	for capability := range client.capabilities {
+		state.Capabilities = append(state.Capabilities, capability)
+	}
+	for mode := range client.flags {
+		state.Flags += mode.String()
+	}
+	if client.ip != nil {
+		state.IP = client.ip.String()
+	}
+	for privilege := range client.operClass {
+		state.OperClass = append(state.OperClass, privilege)
+	}
+	return state
+}
+
+func (channel *Channel) State() *ChannelState {
+	state := &ChannelState{
+		Bans:      channel.lists[BanMask].String(),
+		Excepts:   channel.lists[ExceptMask].String(),
+		Flags:     channel.flags.String(),
+		Invites:   channel.lists[InviteMask].String(),
+		Key:       channel.key.String(),
+		Members:   make(map[string]string),
+		Name:      channel.name.String(),
+		Topic:     channel.topic.String(),
+		UserLimit: channel.userLimit,
+	}
+	for member, modes := range channel.members {
+		state.Members[member.nick.String()] = modes.String()
+	}
+	return state
+}
+
+// Upgrade hands listeners and clients over to a new process, which the caller
+// starts by exec with the environment left here. Clients that cannot be handed
+// over are closed with message. On error the inherited files and detached
+// connections are closed again, so that a plain restart can bind the
+// listeners.
+func (server *Server) Upgrade(message Text) (err error) {
+	detached := make([]*Client, 0)
+	defer func() {
+		if err != nil {
+			for _, file := range server.inherited {
+				file.Close()
+			}
+			server.inherited = nil
+			for _, client := range detached {
+				client.socket.CloseDetached()
+			}
+		}
+	}()
+
+	state := &UpgradeState{
+		Created:   server.ctime,
+		Listeners: make(map[string]uintptr),
+	}
+
+	for addr, listener := range server.listeners {
+		file, err := listener.tcp.File()
+		if err != nil {
+			return err
+		}
+		listener.Stop()
+		delete(server.listeners, addr)
+		if state.Listeners[addr], err = server.inherit(file); err != nil {
+			return err
+		}
+	}
+
+	server.persistChannels()
+
+	// Every socket flushes at once, so slow clients share one CLOSE_TIMEOUT.
+	sockets := make([]*Socket, 0)
+	for client := range server.conns {
+		if client.registered {
+			client.Reply(RplNotice(server, client, "upgrading, please wait"))
+			err := client.socket.Detach()
+			if err == nil {
+				detached = append(detached, client)
+				sockets = append(sockets, client.socket)
+				continue
+			}
+			Log.debug.Printf("%s upgrade: %s", client, err)
+		}
+		sockets = append(sockets, client.socket)
+		client.Quit(message)
+	}
+
+	if !WaitClosed(sockets, CLOSE_TIMEOUT) {
+		Log.warn.Printf("%s send queues not drained", server)
+	}
+
+	for _, client := range detached {
+		file, err := client.socket.File()
+		if err != nil {
+			Log.debug.Printf("%s upgrade: %s", client, err)
+			client.Quit(message)
+			continue
+		}
+		fd, err := server.inherit(file)
+		if err != nil {
+			return err
+		}
+		state.Clients = append(state.Clients, client.State(fd))
+	}
+
+	for _, channel := range server.channels.byName {
+		state.Channels = append(state.Channels, channel.State())
+	}
+
+	if err = server.writeUpgradeState(state); err != nil {
+		return err
+	}
+
+	server.db.Close()
+	server.stopped = true
+	return nil
+}
+
+func (server *Server) writeUpgradeState(state *UpgradeState) error {
+	path, err := filepath.Abs(server.upgradeFile)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = json.NewEncoder(file).Encode(state); err != nil {
+		return err
+	}
+	return os.Setenv(UPGRADE_ENV, path)
+}
+
+// LoadUpgradeState reads the state left by the server this process replaced,
+// if any. The state file is removed, so it is only used once.
+func LoadUpgradeState() (*UpgradeState, error) {
+	path := os.Getenv(UPGRADE_ENV)
+	if path == "" {
+		return nil, nil
+	}
+	os.Unsetenv(UPGRADE_ENV)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	defer file.Close()
+
+	state := &UpgradeState{}
+	if err = json.NewDecoder(file).Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// resume rebuilds listeners, clients and channels from the state left by the
+// previous server. Inherited listeners missing from listeners are closed.
+func (server *Server) resume(state *UpgradeState, listeners map[string]*ListenerConfig) {
+	server.ctime = state.Created
+
+	for addr, fd := range state.Listeners {
+		if err := server.resumeListener(addr, fd, listeners[addr]); err != nil {
+			Log.error.Printf("%s resume %s: %s", server, addr, err)
+		}
+	}
+
+	for _, clientState := range state.Clients {
+		if err := server.resumeClient(clientState); err != nil {
+			Log.error.Printf("%s resume %s: %s", server, clientState.Nick, err)
+		}
+	}
+
+	for _, channelState := range state.Channels {
+		server.resumeChannel(channelState)
+	}
+
+	for client := range server.conns {
+		client.Reply(RplNotice(server, client, NewText("upgraded to "+SEM_VER)))
+		server.checkNickProtection(client)
+	}
+	Log.info.Printf("%s resumed %d clients", server, len(server.conns))
+}
+
+func (server *Server) resumeListener(addr string, fd uintptr, config *ListenerConfig) error {
+	file := os.NewFile(fd, addr)
+	defer file.Close()
+	if config == nil {
+		return nil
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return err
+	}
+	return server.serve(addr, config, listener.(*net.TCPListener))
+}
+
+func (server *Server) resumeClient(state *ClientState) error {
+	file := os.NewFile(state.FD, state.Nick)
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	client := newClient(server, conn)
+	client.account = NewName(state.Account)
+	client.authorized = true
+	client.awayMessage = NewText(state.AwayMessage)
+	client.capState = CapNegotiated
+	client.capVersion = state.CapVersion
+	client.ctime = state.Created
+	client.hostname = NewName(state.Hostname)
+	client.realname = NewText(state.Realname)
+	client.username = NewName(state.Username)
+	for _, capability := range state.Capabilities {
+		if server.capabilities[capability] {
+			client.capabilities[capability] = true
+		}
+	}
+	for _, mode := range state.Flags {
+		client.flags[UserMode(mode)] = true
+	}
+	if len(state.OperClass) > 0 {
+		client.operClass = make(OperClass)
+		for _, privilege := range state.OperClass {
+			client.operClass[privilege] = true
+		}
+	}
+	client.operName = NewName(state.OperName)
+
+	if ip := net.ParseIP(state.IP); ip != nil {
+		server.connLimit.Count(ip)
+		client.ip = ip
+	}
+	client.fakelag.SetExempt(server.fakelag.exempt.Contains(client.ip))
+	client.fakelag.SetOper(client.flags[Operator])
+
+	client.SetNickname(NewName(state.Nick))
+	client.Register()
+	client.socket.Replay(state.Unhandled)
+	go client.readCommands()
+	return nil
+}
+
+func (server *Server) resumeChannel(state *ChannelState) {
+	name := NewName(state.Name)
+	channel := server.channels.Get(name)
+	if channel == nil {
+		channel = NewChannel(server, name)
+	}
+
+	channel.flags = make(ChannelModeSet)
+	for _, mode := range state.Flags {
+		channel.flags[ChannelMode(mode)] = true
+	}
+	channel.key = NewText(state.Key)
+	channel.topic = NewText(state.Topic)
+	channel.userLimit = state.UserLimit
+	for mode, list := range map[ChannelMode]string{
+		BanMask:    state.Bans,
+		ExceptMask: state.Excepts,
+		InviteMask: state.Invites,
+	} {
+		channel.lists[mode] = NewUserMaskSet(server.limits.maxList)
+		loadChannelList(channel, list, mode)
+	}
+
+	for nick, modes := range state.Members {
+		client := server.clients.Get(NewName(nick))
+		if client == nil {
+			continue
+		}
+		channel.members.Add(client)
+		for _, mode := range modes {
+			channel.members[client][ChannelMode(mode)] = true
+		}
+		client.channels.Add(channel)
+	}
+
+	if channel.IsEmpty() && !channel.flags[Persistent] {
+		server.channels.Remove(channel)
+	}
+}
@@ -0,0 +1,130 @@
+package irc
+
+import (
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	// As main does: the loggers made before devNull was opened write nowhere.
+	Log.SetLevel("warn")
+}
+
+func newTestServer(t *testing.T) *Server {
+	config := &Config{}
+	config.Server.Name = "irc.test"
+	config.Server.Database = filepath.Join(t.TempDir(), "test.db")
+	InitDB(config.Server.Database, config.Casemapping())
+	server := NewServer(config)
+	t.Cleanup(func() {
+		server.db.Close()
+	})
+	return server
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (conn net.Conn, peer net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen:", err)
+	}
+	defer listener.Close()
+
+	if peer, err = net.Dial("tcp", listener.Addr().String()); err != nil {
+		t.Fatal("Dial:", err)
+	}
+	if conn, err = listener.Accept(); err != nil {
+		t.Fatal("Accept:", err)
+	}
+	t.Cleanup(func() {
+		peer.Close()
+	})
+	return
+}
+
+// nextCommand takes the next command from a client goroutine, as the server
+// goroutine would.
+func nextCommand(t *testing.T, server *Server) Command {
+	select {
+	case command := <-server.commands:
+		return command
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command")
+		return nil
+	}
+}
+
+func TestUpgradeClient(t *testing.T) {
+	server := newTestServer(t)
+	conn, peer := tcpPair(t)
+	NewClient(server, conn)
+
+	peer.Write([]byte("NICK alice\r\nUSER a 0 * :Alice\r\nJOIN #test\r\n"))
+	// PROXY, then the lines
+	for count := 0; count < 4; count++ {
+		server.processCommand(nextCommand(t, server))
+	}
+	client := server.clients.Get(NewName("alice"))
+	if (client == nil) || !client.registered {
+		t.Fatal("alice did not register")
+	}
+
+	// The first line is read but never taken by the server, and the second
+	// has not arrived in full when the socket is detached.
+	peer.Write([]byte("PRIVMSG #test :one\r\nPRIVMSG #test :tw"))
+	deadline := time.Now().Add(5 * time.Second)
+	for client.socket.Unhandled() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("line not read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.socket.Detach(); err != nil {
+		t.Fatal("Detach:", err)
+	}
+	file, err := client.socket.File()
+	if err != nil {
+		t.Fatal("File:", err)
+	}
+	// The state owns a copy, since the file closes its own on finalization.
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal("Dup:", err)
+	}
+	state := &UpgradeState{
+		Channels: []*ChannelState{server.channels.Get(NewName("#test")).State()},
+		Clients:  []*ClientState{client.State(uintptr(fd))},
+		Created:  server.ctime,
+	}
+	peer.Write([]byte("o\r\n"))
+
+	server = newTestServer(t)
+	server.resume(state, nil)
+	client = server.clients.Get(NewName("alice"))
+	if client == nil {
+		t.Fatal("alice was not resumed")
+	}
+	if (client.username.String() != "a") || (client.realname.String() != "Alice") {
+		t.Errorf("alice is %s %s, expected a Alice", client.username, client.realname)
+	}
+	channel := server.channels.Get(NewName("#test"))
+	if (channel == nil) || !channel.members.HasMode(client, ChannelOperator) {
+		t.Error("alice is not an operator of #test")
+	}
+
+	for _, expected := range []string{"one", "two"} {
+		command := nextCommand(t, server)
+		privMsg, ok := command.(*PrivMsgCommand)
+		if !ok || (command.Client() != client) {
+			t.Fatalf("got %#v, expected PRIVMSG from alice", command)
+		}
+		if privMsg.message.String() != expected {
+			t.Errorf("PRIVMSG %q, expected %q", privMsg.message, expected)
+		}
+	}
+}
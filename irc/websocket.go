@@ -0,0 +1,131 @@
+package irc
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// IRC authentication happens inside the stream, so a session opened
+		// from any origin carries no privileges.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	crlfBytes = []byte(CRLF)
+)
+
+// WSConn adapts a WebSocket to the net.Conn that Socket reads lines from and
+// writes lines to. Each text frame carries exactly one IRC line.
+type WSConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+	readBuf    []byte
+	writeBuf   []byte
+}
+
+func NewWSConn(conn *websocket.Conn) *WSConn {
+	return &WSConn{
+		Conn:       conn,
+		remoteAddr: conn.RemoteAddr(),
+	}
+}
+
+func (conn *WSConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *WSConn) Read(b []byte) (int, error) {
+	for len(conn.readBuf) == 0 {
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		// Binary and control frames are not IRC.
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		conn.readBuf = append(bytes.TrimRight(msg, CRLF), '\n')
+	}
+	n := copy(b, conn.readBuf)
+	conn.readBuf = conn.readBuf[n:]
+	return n, nil
+}
+
+func (conn *WSConn) Write(b []byte) (int, error) {
+	conn.writeBuf = append(conn.writeBuf, b...)
+	for {
+		index := bytes.Index(conn.writeBuf, crlfBytes)
+		if index < 0 {
+			break
+		}
+		err := conn.WriteMessage(websocket.TextMessage, conn.writeBuf[:index])
+		if err != nil {
+			return 0, err
+		}
+		conn.writeBuf = conn.writeBuf[index+len(crlfBytes):]
+	}
+	return len(b), nil
+}
+
+func (conn *WSConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+// forwardedIP walks X-Forwarded-For from the nearest hop outward. The first
+// address that is not itself a trusted proxy is the client.
+func forwardedIP(header string, proxies IPNets) net.IP {
+	hops := strings.Split(header, ",")
+	for index := len(hops) - 1; index >= 0; index -= 1 {
+		ip := net.ParseIP(strings.TrimSpace(hops[index]))
+		if ip == nil {
+			return nil
+		}
+		if !proxies.Contains(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+//
+// websocket listen goroutine
+//
+
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		Log.error.Printf("%s websocket upgrade error: %s", s, err)
+		return
+	}
+	conn := NewWSConn(ws)
+
+	// Only trusted proxies may speak for the client's address.
+	header := r.Header.Get("X-Forwarded-For")
+	if (header != "") && s.proxies.Contains(AddrIP(ws.RemoteAddr())) {
+		if ip := forwardedIP(header, s.proxies); ip != nil {
+			conn.remoteAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	Log.debug.Printf("%s accept: %s", s, conn.RemoteAddr())
+
+	s.newConns <- conn
+}
+
+func (s *Server) wsListen(listener *ServerListener) {
+	go func() {
+		err := http.Serve(listener, http.HandlerFunc(s.wsHandler))
+		if listener.IsStopped() {
+			return
+		}
+		Log.error.Printf("%s websocket serve error: %s", s, err)
+	}()
+}